@@ -0,0 +1,118 @@
+package channel
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+/*
+Address identifies a friend by the hex encoded public key of its Tox ID. Use
+ParseAddress to get one from user input.
+*/
+type Address string
+
+/*
+Sizes of the parts of a full Tox ID in bytes.
+*/
+const (
+	publicKeySize = 32
+	nospamSize    = 4
+	checksumSize  = 2
+	toxIDSize     = publicKeySize + nospamSize + checksumSize
+)
+
+/*
+ValidateAddress checks whether the given string is a valid full Tox ID as
+returned by ConnectionAddress: correct length, hex encoded, and with a matching
+checksum.
+*/
+func ValidateAddress(id string) error {
+	if len(id) != 2*toxIDSize {
+		return ErrInvalidLength
+	}
+	data, err := hex.DecodeString(id)
+	if err != nil {
+		return ErrInvalidHex
+	}
+	checksum := toxChecksum(data[:publicKeySize+nospamSize])
+	if checksum[0] != data[toxIDSize-2] || checksum[1] != data[toxIDSize-1] {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+/*
+toxChecksum calculates the checksum of a Tox ID: all bytes XORed into two.
+*/
+func toxChecksum(data []byte) [checksumSize]byte {
+	var checksum [checksumSize]byte
+	for index, value := range data {
+		checksum[index%checksumSize] ^= value
+	}
+	return checksum
+}
+
+/*
+ParseAddress returns the Address of the given public key or full Tox ID. Full Tox
+IDs are validated like ValidateAddress does.
+*/
+func ParseAddress(id string) (Address, error) {
+	id = strings.ToLower(id)
+	switch len(id) {
+	case 2 * publicKeySize:
+		if _, err := hex.DecodeString(id); err != nil {
+			return "", ErrInvalidHex
+		}
+		return Address(id), nil
+	case 2 * toxIDSize:
+		if err := ValidateAddress(id); err != nil {
+			return "", err
+		}
+		return Address(id[:2*publicKeySize]), nil
+	default:
+		return "", ErrInvalidLength
+	}
+}
+
+/*
+addressOfKey returns the Address of the given public key.
+*/
+func addressOfKey(publicKey []byte) Address {
+	return Address(hex.EncodeToString(publicKey[:publicKeySize]))
+}
+
+/*
+PublicKey returns the decoded public key of the address.
+*/
+func (a Address) PublicKey() ([]byte, error) {
+	if len(a) != 2*publicKeySize {
+		return nil, ErrInvalidLength
+	}
+	key, err := hex.DecodeString(string(a))
+	if err != nil {
+		return nil, ErrInvalidHex
+	}
+	return key, nil
+}
+
+/*
+Valid returns whether the address is a well formed public key.
+*/
+func (a Address) Valid() bool {
+	_, err := a.PublicKey()
+	return err == nil
+}
+
+/*
+Equal returns whether both addresses denote the same public key, ignoring case.
+*/
+func (a Address) Equal(other Address) bool {
+	return strings.EqualFold(string(a), string(other))
+}
+
+/*
+String returns the hex encoded public key.
+*/
+func (a Address) String() string {
+	return string(a)
+}
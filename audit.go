@@ -0,0 +1,67 @@
+package channel
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+auditRecord is a single line of the audit log.
+*/
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Address Address   `json:"address,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Type    string    `json:"type,omitempty"`
+}
+
+/*
+auditLog writes events as JSON lines. A nil auditLog writes nothing.
+*/
+type auditLog struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	log     Logger
+}
+
+/*
+buildAuditLog returns an audit log writing to the given writer, or nil if there
+is none.
+*/
+func buildAuditLog(writer io.Writer, log Logger) *auditLog {
+	if writer == nil {
+		return nil
+	}
+	return &auditLog{encoder: json.NewEncoder(writer), log: log}
+}
+
+/*
+write the given event as one line.
+*/
+func (a *auditLog) write(event Event) {
+	if a == nil {
+		return
+	}
+	record := auditRecord{
+		Time:    time.Now().UTC(),
+		Event:   strings.Replace(event.Kind.String(), " ", "_", -1),
+		Address: event.Address,
+		Path:    event.Path}
+	switch event.Kind {
+	case EvTransferDone:
+		record.State = event.State.String()
+	case EvFriendOnline, EvSelfOnline:
+		record.Type = event.Type.String()
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// json.Encoder terminates every record with a newline
+	if err := a.encoder.Encode(record); err != nil {
+		a.log.Warn("Audit log:", err)
+	}
+}
@@ -1,24 +1,242 @@
 package channel
 
+import "sync/atomic"
+
 /*
-Callbacks for external wrapped access. NOTE: all callbacks except for the
-OnAllowFile are called via go routines to keep ToxCore ticking steadily. This
-works because the ToxCore routine itself keeps running, thus allowing its child
-routines to execute too, even if the method returns.
+Callbacks for external wrapped access. NOTE: all callbacks are run by a pool of
+workers to keep ToxCore ticking steadily. All
+callbacks for the same address run on the same worker and thus in order, so a
+slow callback delays the following ones of its address. If no callbacks are given
+to Create an empty Funcs is used, so there is always a valid implementation.
 */
 type Callbacks interface {
 	/*OnNewConnection is called on a Tox friend request.*/
-	OnFriendRequest(address, message string)
-	/*OnMessage is called on an incomming message.*/
-	OnMessage(address, message string)
+	OnFriendRequest(address Address, message string)
+	/*OnMessage is called on an incomming message. The kind allows
+	distinguishing normal messages from actions.*/
+	OnMessage(address Address, message string, kind MessageType)
 	/*OnAllowFile is called when a file transfer is wished. Returns the
-	permission as bool and the path where to write the file.*/
-	OnAllowFile(address, name string) (bool, string)
+	permission as bool and the path where to write the file. Returning true
+	with an empty path leaves the offer pending, to be decided later with
+	AcceptIncoming or RejectIncoming within Options.IncomingTTL.*/
+	OnAllowFile(address Address, name string) (bool, string)
 	/*OnFileReceived is called once the file has been successfully
 	received completely.*/
-	OnFileReceived(address, path, name string)
+	OnFileReceived(address Address, path, name string)
 	/*OnFileCanceled is called if a file transfer is canceled by the other side.*/
-	OnFileCanceled(address, path string)
-	/*OnConnected is called when a friend comes online.*/
-	OnConnected(address string)
+	OnFileCanceled(address Address, path string)
+	/*OnConnected is called when a friend comes online. The kind tells whether
+	the connection is direct or relayed.*/
+	OnConnected(address Address, kind ConnectionType)
+	/*OnFriendAdded is called when an address has been added to the friend list.*/
+	OnFriendAdded(address Address)
+	/*OnFriendListChanged is called whenever the friend list has changed,
+	including additions and removals.*/
+	OnFriendListChanged()
+	/*OnStatusChange is called when a friend changes their user status.*/
+	OnStatusChange(address Address, status UserStatus)
+	/*OnNameChange is called when a friend changes their name.*/
+	OnNameChange(address Address, name string)
+	/*OnStatusMessageChange is called when a friend changes their status
+	message.*/
+	OnStatusMessageChange(address Address, message string)
+	/*OnConnectionTypeChanged is called when a connected friend switches
+	between a direct and a relayed connection without disconnecting.*/
+	OnConnectionTypeChanged(address Address, kind ConnectionType)
+	/*OnNetworkStatus is called when the channel comes online or goes
+	offline. When coming online nodes contains the bootstrap nodes that
+	accepted the last bootstrap request.*/
+	OnNetworkStatus(online bool, nodes []Node)
+	/*OnSelfConnectionStatus is called when the connection of the channel to
+	the Tox network changes: CtUDP or CtTCP when online, CtNone when offline.*/
+	OnSelfConnectionStatus(kind ConnectionType)
+}
+
+/*
+Funcs is a Callbacks implementation composed of optional functions so that only
+the required events must be implemented. Any function left nil falls back to a
+sensible default: friend requests and messages are dropped and counted, files are
+rejected, and all other events are ignored.
+*/
+type Funcs struct {
+	FriendRequest         func(address Address, message string)
+	Message               func(address Address, message string, kind MessageType)
+	AllowFile             func(address Address, name string) (bool, string)
+	FileReceived          func(address Address, path, name string)
+	FileCanceled          func(address Address, path string)
+	Connected             func(address Address, kind ConnectionType)
+	FriendAdded           func(address Address)
+	FriendListChanged     func()
+	StatusChange          func(address Address, status UserStatus)
+	NameChange            func(address Address, name string)
+	StatusMessageChange   func(address Address, message string)
+	ConnectionTypeChanged func(address Address, kind ConnectionType)
+	NetworkStatus         func(online bool, nodes []Node)
+	SelfConnectionStatus  func(kind ConnectionType)
+	dropped               uint64    // counter of dropped events, accessed atomically
+	wrapped               Callbacks // called for the functions left nil, if set
+}
+
+/*
+Dropped returns the number of friend requests and messages that were dropped
+because no function was set for them.
+*/
+func (f *Funcs) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+/*
+clone returns a copy of the Funcs, reading the dropped counter atomically as
+events may be delivered concurrently.
+*/
+func (f *Funcs) clone() *Funcs {
+	return &Funcs{
+		FriendRequest:         f.FriendRequest,
+		Message:               f.Message,
+		AllowFile:             f.AllowFile,
+		FileReceived:          f.FileReceived,
+		FileCanceled:          f.FileCanceled,
+		Connected:             f.Connected,
+		FriendAdded:           f.FriendAdded,
+		FriendListChanged:     f.FriendListChanged,
+		StatusChange:          f.StatusChange,
+		NameChange:            f.NameChange,
+		StatusMessageChange:   f.StatusMessageChange,
+		ConnectionTypeChanged: f.ConnectionTypeChanged,
+		NetworkStatus:         f.NetworkStatus,
+		SelfConnectionStatus:  f.SelfConnectionStatus,
+		dropped:               f.Dropped(),
+		wrapped:               f.wrapped}
+}
+
+/*OnFriendRequest calls FriendRequest or the wrapped Callbacks, or drops it.*/
+func (f *Funcs) OnFriendRequest(address Address, message string) {
+	if f.FriendRequest != nil {
+		f.FriendRequest(address, message)
+	} else if f.wrapped != nil {
+		f.wrapped.OnFriendRequest(address, message)
+	} else {
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+/*OnMessage calls Message or the wrapped Callbacks, or drops the message.*/
+func (f *Funcs) OnMessage(address Address, message string, kind MessageType) {
+	if f.Message != nil {
+		f.Message(address, message, kind)
+	} else if f.wrapped != nil {
+		f.wrapped.OnMessage(address, message, kind)
+	} else {
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+/*OnAllowFile calls AllowFile or the wrapped Callbacks, or rejects the file.*/
+func (f *Funcs) OnAllowFile(address Address, name string) (bool, string) {
+	if f.AllowFile != nil {
+		return f.AllowFile(address, name)
+	}
+	if f.wrapped != nil {
+		return f.wrapped.OnAllowFile(address, name)
+	}
+	return false, ""
+}
+
+/*OnFileReceived calls FileReceived if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnFileReceived(address Address, path, name string) {
+	if f.FileReceived != nil {
+		f.FileReceived(address, path, name)
+	} else if f.wrapped != nil {
+		f.wrapped.OnFileReceived(address, path, name)
+	}
+}
+
+/*OnFileCanceled calls FileCanceled if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnFileCanceled(address Address, path string) {
+	if f.FileCanceled != nil {
+		f.FileCanceled(address, path)
+	} else if f.wrapped != nil {
+		f.wrapped.OnFileCanceled(address, path)
+	}
+}
+
+/*OnConnected calls Connected if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnConnected(address Address, kind ConnectionType) {
+	if f.Connected != nil {
+		f.Connected(address, kind)
+	} else if f.wrapped != nil {
+		f.wrapped.OnConnected(address, kind)
+	}
+}
+
+/*OnFriendAdded calls FriendAdded if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnFriendAdded(address Address) {
+	if f.FriendAdded != nil {
+		f.FriendAdded(address)
+	} else if f.wrapped != nil {
+		f.wrapped.OnFriendAdded(address)
+	}
+}
+
+/*OnFriendListChanged calls FriendListChanged if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnFriendListChanged() {
+	if f.FriendListChanged != nil {
+		f.FriendListChanged()
+	} else if f.wrapped != nil {
+		f.wrapped.OnFriendListChanged()
+	}
+}
+
+/*OnStatusChange calls StatusChange if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnStatusChange(address Address, status UserStatus) {
+	if f.StatusChange != nil {
+		f.StatusChange(address, status)
+	} else if f.wrapped != nil {
+		f.wrapped.OnStatusChange(address, status)
+	}
+}
+
+/*OnNameChange calls NameChange if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnNameChange(address Address, name string) {
+	if f.NameChange != nil {
+		f.NameChange(address, name)
+	} else if f.wrapped != nil {
+		f.wrapped.OnNameChange(address, name)
+	}
+}
+
+/*OnStatusMessageChange calls StatusMessageChange if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnStatusMessageChange(address Address, message string) {
+	if f.StatusMessageChange != nil {
+		f.StatusMessageChange(address, message)
+	} else if f.wrapped != nil {
+		f.wrapped.OnStatusMessageChange(address, message)
+	}
+}
+
+/*OnConnectionTypeChanged calls ConnectionTypeChanged if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnConnectionTypeChanged(address Address, kind ConnectionType) {
+	if f.ConnectionTypeChanged != nil {
+		f.ConnectionTypeChanged(address, kind)
+	} else if f.wrapped != nil {
+		f.wrapped.OnConnectionTypeChanged(address, kind)
+	}
+}
+
+/*OnNetworkStatus calls NetworkStatus if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnNetworkStatus(online bool, nodes []Node) {
+	if f.NetworkStatus != nil {
+		f.NetworkStatus(online, nodes)
+	} else if f.wrapped != nil {
+		f.wrapped.OnNetworkStatus(online, nodes)
+	}
+}
+
+/*OnSelfConnectionStatus calls SelfConnectionStatus if set, or the wrapped Callbacks.*/
+func (f *Funcs) OnSelfConnectionStatus(kind ConnectionType) {
+	if f.SelfConnectionStatus != nil {
+		f.SelfConnectionStatus(kind)
+	} else if f.wrapped != nil {
+		f.wrapped.OnSelfConnectionStatus(kind)
+	}
 }
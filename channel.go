@@ -1,9 +1,9 @@
 package channel
 
 import (
-	"errors"
-	"log"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/codedust/go-tox"
 )
@@ -13,13 +13,74 @@ Channel is a wrapper of the gotox wrapper that creates and manages the underlyin
 instance.
 */
 type Channel struct {
-	tox        *gotox.Tox                // tox wrapper instance
-	callbacks  Callbacks                 // callbacks that channel may call
-	wg         sync.WaitGroup            // for background thread
-	stop       chan bool                 // for background thread
-	transfers  map[uint32]*transfer      // map of all ongoing transfers: key is Tox file number
-	sending    map[string]chan *transfer // map of pending transfers: key is address where transfer is going to
-	sendActive map[string]*sendTransfer
+	tox           *lockedTox                     // tox wrapper instance
+	custom        bool                           // set if tox was given instead of created by gotox
+	callbacks     Callbacks                      // callbacks that channel may call
+	wg            sync.WaitGroup                 // for background thread
+	stop          chan bool                      // for background thread
+	stopped       chan bool                      // closed once the background thread has stopped
+	closeOnce     sync.Once                      // makes Close idempotent
+	closed        int32                          // set once Tox was killed, accessed atomically
+	done          chan bool                      // closed once Close has finished
+	transfers     *transferTable                 // all file transfers
+	receipts      map[receipt]chan bool          // map of messages waiting for a read receipt
+	receiptMut    sync.Mutex                     // protects receipts as they are written from outside the background thread
+	limit         bucket                         // rate limit shared by messages and file chunks
+	deferred      []chunkRequest                 // chunk requests waiting for the rate limit
+	cipher        Cipher                         // optional application level encryption of messages
+	cipherMut     sync.RWMutex                   // protects cipher as it may be replaced with SetCipher
+	options       Options                        // options the channel was created with
+	outbox        lanes                          // queued messages by priority
+	streams       map[Address]*stream            // open streams: key is address
+	streamMut     sync.Mutex                     // protects streams as they are opened from outside the background thread
+	counters      counters                       // counters for Stats
+	pings         *pinger                        // pings waiting for pongs and measured round trip times
+	parked        parking                        // transfers waiting for their address to come online
+	incoming      incoming                       // file offers awaiting a decision
+	hooks         []func()                       // shutdown hooks, called in order of registration
+	hookMut       sync.Mutex                     // protects hooks
+	side          *sidecar                       // channel data persisted with the ToxData
+	seen          seen                           // when each address was last seen
+	requests      pendingRequests                // friend requests not yet accepted or rejected
+	trusted       map[Address]bool               // addresses whose friend requests are accepted automatically
+	resends       resends                        // friend requests that are re-sent until accepted
+	connStatus    map[uint32]gotox.ToxConnection // last known connection status: key is Tox friend number
+	quality       quality                        // connection quality per address
+	nodes         []Node                         // bootstrap nodes
+	nodeMut       sync.Mutex                     // protects nodes
+	bootstrapped  []Node                         // nodes that accepted the last bootstrap request
+	online        bool                           // whether the channel was online at the last check
+	everOnline    bool                           // whether the channel was ever online
+	rotation      []Node                         // nodes not yet bootstrapped to in the current rotation
+	bootStarted   time.Time                      // start of the last bootstrap round that has not brought us online yet, if any
+	rebootstrap   chan chan error                // requests for an immediate bootstrap round from Bootstrap
+	bootWaiters   []chan error                   // Bootstrap calls waiting for the nodes to be fetched
+	fetched       chan []Node                    // nodes fetched in the background for the background thread
+	fetching      bool                           // whether nodes are being fetched in the background
+	events        events                         // subscribers of typed events
+	paused        int32                          // set while networking is paused by GoOffline, accessed atomically
+	bootFailures  int                            // consecutive bootstrap rounds that didn't bring us online
+	bootSpan      Span                           // traces the current bootstrap round, nil if none
+	lastBootstrap int64                          // unix nanoseconds when the channel last came online, accessed atomically
+	timings       *timings                       // distributions of chunk and transfer timings
+	lastTick      int64                          // unix nanoseconds of the last iteration, accessed atomically
+	selfType      int32                          // ConnectionType of the channel at the last check, accessed atomically
+	graceUntil    time.Time                      // until when only the DHT nodes of the savedata are used, if set
+	created       time.Time                      // when the channel was created
+	idleChecks    chan chan bool                 // requests from CloseGraceful whether all work is done
+	dumps         chan chan *debugState          // requests from DebugDump for a snapshot of the state
+	commands      chan func()                    // work of public methods on the state owned by the background thread
+	closing       int32                          // set once CloseGraceful was called, accessed atomically
+	restarts      chan restart                   // requests to replace the Tox instance
+	suspends      chan chan bool                 // requests from Suspend to park the background thread
+	resume        chan bool                      // closed by Resume, nil if not suspended
+	suspendMut    sync.Mutex                     // protects resume
+	logger        *levelLogger                   // receives all log output
+	audit         *auditLog                      // writes all events if Options.AuditLog is set
+	dirty         int32                          // set if the ToxData must be persisted, accessed atomically
+	callbackMut   sync.RWMutex                   // protects callbacks as they may be replaced with SetCallbacks
+	dispatcher    *dispatcher                    // runs the callbacks
+	routines      *routines                      // starts and counts the goroutines for profiling
 }
 
 /*
@@ -27,64 +88,204 @@ Create and starts a new tox channel that continously runs in the background
 until this object is destroyed.
 */
 func Create(name string, toxdata []byte, callbacks Callbacks) (*Channel, error) {
+	return CreateWithOptions(name, toxdata, callbacks, nil)
+}
+
+/*
+CreateWithContext creates a channel like CreateWithOptions, but returns the
+context error if the context expires first. A channel that is created anyway is
+closed in the background.
+*/
+func CreateWithContext(ctx context.Context, name string, toxdata []byte, callbacks Callbacks, options *Options) (*Channel, error) {
+	type created struct {
+		channel *Channel
+		err     error
+	}
+	done := make(chan created, 1)
+	go func() {
+		channel, err := CreateWithOptions(name, toxdata, callbacks, options)
+		done <- created{channel: channel, err: err}
+	}()
+	select {
+	case result := <-done:
+		return result.channel, result.err
+	case <-ctx.Done():
+		go func() {
+			result := <-done
+			if result.err == nil {
+				result.channel.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+/*
+CreateWithOptions creates and starts a new tox channel like Create, using the
+given options. If options is nil the DefaultOptions are used.
+*/
+func CreateWithOptions(name string, toxdata []byte, callbacks Callbacks, options *Options) (*Channel, error) {
 	// other than name everyhting may be nil
 	if name == "" {
-		return nil, errors.New("CreateChannel called with no name!")
+		return nil, ErrEmptyName
+	}
+	channel, toxdata, err := buildChannel(toxdata, options, false)
+	if err != nil {
+		return nil, err
 	}
 	var init bool
-	var channel = &Channel{}
-	var options *gotox.Options
-	var err error
-
-	// prepare for file transfers
-	channel.transfers = make(map[uint32]*transfer)
-	channel.sendActive = make(map[string]*sendTransfer)
-	channel.sending = make(map[string]chan *transfer)
-
 	// this decides whether we are initiating a new connection or using an existing one
 	if toxdata == nil {
-		log.Println("Channel:", "WARNING create called with empty ToxData.")
-		// updated from gotox: nil options okay on first init
-		options = nil
+		channel.logger.Warn("Create called with empty ToxData.")
 		init = true
-	} else {
-		options = &gotox.Options{
-			IPv6Enabled:  true,
-			UDPEnabled:   true,
-			ProxyType:    gotox.TOX_PROXY_TYPE_NONE,
-			ProxyHost:    "127.0.0.1",
-			ProxyPort:    5555,
-			StartPort:    0,
-			EndPort:      0,
-			TcpPort:      0,
-			SaveDataType: gotox.TOX_SAVEDATA_TYPE_TOX_SAVE,
-			SaveData:     toxdata}
-		init = false
+	} else if channel.options.UseSavedNodes {
+		// give the DHT nodes in the savedata a chance first
+		channel.graceUntil = time.Now().Add(channel.options.SavedNodesGrace)
 	}
-	channel.tox, err = gotox.New(options)
+	tox, err := gotox.New(channel.options.toxOptions(toxdata))
 	if err != nil {
-		return nil, err
+		return nil, toxErr("New", err)
 	}
+	channel.tox = lockTox(tox)
 	// if init, AFTER creating the tox instance, set these
 	if init {
 		channel.tox.SelfSetName(name)
 		channel.tox.SelfSetStatusMessage("Tinzenite Peer")
 	}
-	err = channel.tox.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
-	// Register our callbacks
+	channel.start(callbacks)
+	return channel, nil
+}
+
+/*
+buildChannel prepares a channel with the given options without a Tox instance,
+returning the tox data that is left once our own data has been split off. Custom
+is set if the Tox instance will be given instead of created by gotox.
+*/
+func buildChannel(toxdata []byte, options *Options, custom bool) (*Channel, []byte, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	var channel = &Channel{options: options.sanitize(), custom: custom, created: time.Now()}
+	channel.lastTick = channel.created.UnixNano()
+	channel.timings = buildTimings()
+	channel.logger = buildLevelLogger(channel.options.Logger, channel.options.LogLevel)
+	channel.audit = buildAuditLog(channel.options.AuditLog, channel.logger)
+	var err error
+
+	// normalize trusted addresses for lookup
+	channel.trusted = make(map[Address]bool)
+	for _, address := range channel.options.TrustedAddresses {
+		key, err := ParseAddress(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		channel.trusted[key] = true
+	}
+
+	// use custom bootstrap nodes if given
+	channel.nodes = channel.options.BootstrapNodes
+
+	// fail early if we can't reach enough nodes, a given backend has none to reach
+	if channel.options.RequireMinNodes && !channel.custom {
+		if channel.fetchNodes() < channel.options.MinNodes {
+			return nil, nil, ErrTooFewNodes
+		}
+	}
+
+	// decrypt, then split off our own data that is stored with the tox data
+	toxdata, err = channel.options.openToxData(toxdata)
+	if err != nil {
+		return nil, nil, err
+	}
+	toxdata, channel.side, err = unpackSidecar(toxdata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// prepare for file transfers
+	channel.transfers = buildTransferTable()
+	// prepare for read receipts
+	channel.receipts = make(map[receipt]chan bool)
+	// prepare for streams
+	channel.streams = make(map[Address]*stream)
+	// prepare for connection tracking
+	channel.connStatus = make(map[uint32]gotox.ToxConnection)
+	// prepare for pings
+	channel.pings = buildPinger()
+	// prepare for manual bootstrapping
+	channel.rebootstrap = make(chan chan error)
+	// only one fetch runs at a time, so its result never blocks
+	channel.fetched = make(chan []Node, 1)
+	// prepare for graceful closing
+	channel.idleChecks = make(chan chan bool)
+	channel.dumps = make(chan chan *debugState)
+	// prepare for public methods to hand work to the background thread
+	channel.commands = make(chan func())
+	// prepare for restarting Tox
+	channel.restarts = make(chan restart)
+	// prepare for suspending
+	channel.suspends = make(chan chan bool)
+	return channel, toxdata, nil
+}
+
+/*
+start registers with the Tox instance and starts the background thread.
+*/
+func (channel *Channel) start(callbacks Callbacks) {
+	channel.tox.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
+	channel.registerCallbacks()
+	// label the goroutines with who we are for profiling
+	var address Address
+	if id, err := channel.tox.SelfGetAddress(); err == nil && len(id) >= publicKeySize {
+		address = addressOfKey(id[:publicKeySize])
+	}
+	channel.routines = buildRoutines(address)
+	channel.dispatcher = buildDispatcher(channel.options.CallbackWorkers, channel.routines)
+	// register callbacks, using the defaults if none are given
+	if callbacks == nil {
+		callbacks = &Funcs{}
+	}
+	channel.callbacks = callbacks
+	// now to run it:
+	channel.wg.Add(1)
+	channel.stop = make(chan bool, 0)
+	channel.stopped = make(chan bool)
+	channel.done = make(chan bool)
+	channel.routines.start(subsystemRun, channel.run)
+	channel.logger.Info("Created.")
+}
+
+/*
+createWithTox creates and starts a channel around the given Tox instance instead
+of creating one. Such a channel has no network, so it neither fetches nodes nor
+can it be restarted.
+*/
+func createWithTox(tox toxCore, callbacks Callbacks, options *Options) (*Channel, error) {
+	channel, _, err := buildChannel(nil, options, true)
+	if err != nil {
+		return nil, err
+	}
+	channel.tox = lockTox(tox)
+	channel.start(callbacks)
+	return channel, nil
+}
+
+/*
+registerCallbacks registers our callbacks with the Tox instance.
+*/
+func (channel *Channel) registerCallbacks() {
+	channel.tox.CallbackSelfConnectionStatusChanges(channel.onSelfConnectionStatusChanges)
 	channel.tox.CallbackFriendRequest(channel.onFriendRequest)
 	channel.tox.CallbackFriendMessage(channel.onFriendMessage)
+	channel.tox.CallbackFriendReadReceipt(channel.onFriendReadReceipt)
 	channel.tox.CallbackFriendConnectionStatusChanges(channel.onFriendConnectionStatusChanges)
+	channel.tox.CallbackFriendStatusChanges(channel.onFriendStatusChanges)
+	channel.tox.CallbackFriendNameChanges(channel.onFriendNameChanges)
+	channel.tox.CallbackFriendStatusMessageChanges(channel.onFriendStatusMessageChanges)
 	channel.tox.CallbackFileRecvControl(channel.onFileRecvControl)
 	channel.tox.CallbackFileRecv(channel.onFileRecv)
 	channel.tox.CallbackFileRecvChunk(channel.onFileRecvChunk)
 	channel.tox.CallbackFileChunkRequest(channel.onFileChunkRequest)
-	// register callbacks
-	channel.callbacks = callbacks
-	// now to run it:
-	channel.wg.Add(1)
-	channel.stop = make(chan bool, 0)
-	go channel.run()
-	log.Println("Channel: created.")
-	return channel, nil
+	channel.tox.CallbackFriendLosslessPacket(channel.onFriendLosslessPacket)
+	channel.tox.CallbackFriendLossyPacket(channel.onFriendLossyPacket)
 }
@@ -0,0 +1,73 @@
+package channel
+
+import "sync"
+
+const (
+	// toxChunkSize is the size of the file chunks Tox requests
+	toxChunkSize = 1371
+	// writeBufferSize is the default of Options.WriteBuffer, the only size that is pooled
+	writeBufferSize = 64 * 1024
+)
+
+/*
+chunkBuffers reuses the buffers chunks are read into before sending.
+*/
+var chunkBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, toxChunkSize)
+	return &buffer
+}}
+
+/*
+writeBuffers reuses the buffers received chunks are collected in.
+*/
+var writeBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, 0, writeBufferSize)
+	return &buffer
+}}
+
+/*
+getChunk returns a buffer of the given length for a chunk, pooled unless it is
+larger than Tox chunks are.
+*/
+func getChunk(length uint64) []byte {
+	if length > toxChunkSize {
+		return make([]byte, length)
+	}
+	buffer := chunkBuffers.Get().(*[]byte)
+	return (*buffer)[:length]
+}
+
+/*
+putChunk returns a buffer from getChunk to the pool. Tox copies the data, so
+this is safe once the chunk has been sent.
+*/
+func putChunk(data []byte) {
+	if cap(data) != toxChunkSize {
+		return
+	}
+	data = data[:cap(data)]
+	chunkBuffers.Put(&data)
+}
+
+/*
+getWriteBuffer returns an empty buffer of the given capacity to collect received
+chunks in.
+*/
+func getWriteBuffer(size int) []byte {
+	if size != writeBufferSize {
+		return make([]byte, 0, size)
+	}
+	buffer := writeBuffers.Get().(*[]byte)
+	return (*buffer)[:0]
+}
+
+/*
+putWriteBuffer returns a buffer from getWriteBuffer to the pool.
+*/
+func putWriteBuffer(data []byte) {
+	if cap(data) != writeBufferSize {
+		return
+	}
+	data = data[:0]
+	writeBuffers.Put(&data)
+}
@@ -0,0 +1,67 @@
+package channel
+
+import (
+	"encoding/base64"
+
+	"github.com/codedust/go-tox"
+)
+
+/*
+Cipher allows encrypting message payloads before they are handed to Tox and
+decrypting them once received, for example with a NaCl box keyed per peer. This
+is applied in addition to the Tox encryption for defense in depth.
+*/
+type Cipher interface {
+	/*Encrypt the given message for the given address.*/
+	Encrypt(address Address, message []byte) ([]byte, error)
+	/*Decrypt the given message received from the given address.*/
+	Decrypt(address Address, message []byte) ([]byte, error)
+}
+
+/*
+currentCipher returns the cipher currently set, nil if none.
+*/
+func (channel *Channel) currentCipher() Cipher {
+	channel.cipherMut.RLock()
+	defer channel.cipherMut.RUnlock()
+	return channel.cipher
+}
+
+/*
+seal the message for the given address if a cipher is set. The encrypted data is
+base64 encoded as Tox messages are text, which must still fit a single Tox
+message.
+*/
+func (channel *Channel) seal(address Address, message string) (string, error) {
+	cipher := channel.currentCipher()
+	if cipher == nil {
+		return message, nil
+	}
+	data, err := cipher.Encrypt(address, []byte(message))
+	if err != nil {
+		return "", err
+	}
+	if base64.StdEncoding.EncodedLen(len(data)) > gotox.TOX_MAX_MESSAGE_LENGTH {
+		return "", ErrMessageTooLong
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+/*
+unseal the message from the given address if a cipher is set.
+*/
+func (channel *Channel) unseal(address Address, message string) (string, error) {
+	cipher := channel.currentCipher()
+	if cipher == nil {
+		return message, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return "", err
+	}
+	data, err = cipher.Decrypt(address, data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -6,27 +6,115 @@ import (
 )
 
 /*
-Internal errors of channel.
+Errors returned by channel. Errors of Tox itself are wrapped in a ToxError.
+Use errors.Is to check for them.
 */
 var (
-	errLostAddress      = errors.New("could not determine address")
-	errOffline          = errors.New("address is not online")
-	errBootstrap        = errors.New("failed to bootstrap to any given node")
-	errTransferNotFound = errors.New("could not determine transfer for file name")
-	errSendBufferFull   = errors.New("sending buffer is full")
+	/*ErrLostAddress is returned when the address of a friend can not be determined.*/
+	ErrLostAddress = errors.New("could not determine address")
+	/*ErrOffline is returned when sending to an address that is not online.*/
+	ErrOffline = errors.New("address is not online")
+	/*ErrBootstrap is returned when no bootstrap node accepted the request.*/
+	ErrBootstrap = errors.New("failed to bootstrap to any given node")
+	/*ErrTransferNotFound is returned when no transfer matches the given path.*/
+	ErrTransferNotFound = errors.New("could not determine transfer for file name")
+	/*ErrSendBufferFull is returned when the send queue of an address is full.*/
+	ErrSendBufferFull = errors.New("sending buffer is full")
+	/*ErrRateLimited is returned when an address exceeded its message rate.*/
+	ErrRateLimited = errors.New("rate limit exceeded")
+	/*ErrNoPong is returned when an address has not answered a ping yet.*/
+	ErrNoPong = errors.New("no pong received yet")
+	/*ErrEmptyName is returned when a name is required but empty.*/
+	ErrEmptyName = errors.New("name may not be empty")
+	/*ErrNoAlias is returned when an address has no alias.*/
+	ErrNoAlias = errors.New("no alias set for address")
+	/*ErrCorruptData is returned when saved channel data can not be read.*/
+	ErrCorruptData = errors.New("corrupt channel data")
+	/*ErrInvalidLength is returned for addresses of the wrong length.*/
+	ErrInvalidLength = errors.New("address has invalid length")
+	/*ErrInvalidHex is returned for addresses that are not hex encoded.*/
+	ErrInvalidHex = errors.New("address is not hex encoded")
+	/*ErrInvalidChecksum is returned for addresses with a wrong checksum.*/
+	ErrInvalidChecksum = errors.New("address checksum mismatch")
+	/*ErrNoRequest is returned when no friend request of an address is pending.*/
+	ErrNoRequest = errors.New("no pending friend request for address")
+	/*ErrFriendLimit is returned when the friend list is full.*/
+	ErrFriendLimit = errors.New("maximum number of friends reached")
+	/*ErrNoFullAddress is returned when only the public key of an address is known.*/
+	ErrNoFullAddress = errors.New("full address not known")
+	/*ErrNoMeta is returned when no metadata is stored under a key.*/
+	ErrNoMeta = errors.New("no metadata for key")
+	/*ErrNoPeerStats is returned when no statistics exist for an address.*/
+	ErrNoPeerStats = errors.New("no statistics for address")
+	/*ErrPaused is returned while the channel is offline by request.*/
+	ErrPaused = errors.New("channel is offline by request")
+	/*ErrTooFewNodes is returned when fewer than Options.MinNodes nodes are found.*/
+	ErrTooFewNodes = errors.New("too few bootstrap nodes")
+	/*ErrClosing is returned once the channel is being closed.*/
+	ErrClosing = errors.New("channel is closing")
+	/*ErrClosed is returned by all methods once the channel has been closed.*/
+	ErrClosed = errors.New("channel is closed")
+	/*ErrNotSupported is returned for operations the backend of the channel can't do.*/
+	ErrNotSupported = errors.New("not supported by this backend")
+	/*ErrNotEncrypted is returned when decrypting data that is not encrypted.*/
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	/*ErrWrongPassphrase is returned when encrypted data can not be decrypted.*/
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupt data")
+	/*ErrNoPassphrase is returned for encrypted data when no passphrase is set.*/
+	ErrNoPassphrase = errors.New("data is encrypted but no passphrase is set")
+	/*ErrNoOffer is returned when no file offer is pending under an id.*/
+	ErrNoOffer = errors.New("no pending file offer for id")
+	/*ErrPublished is returned by PublishExpvar if the name is already taken.*/
+	ErrPublished = errors.New("expvar name already published")
+	/*ErrStreamBufferFull is returned when a peer sends more stream data than it has credit for.*/
+	ErrStreamBufferFull = errors.New("stream buffer is full")
+	/*ErrFileTruncated is returned when a mapped file shrinks while it is sent.*/
+	ErrFileTruncated = errors.New("file was truncated while being sent")
+	/*ErrMessageTooLong is returned when an encrypted message exceeds the maximum
+	length of a Tox message.*/
+	ErrMessageTooLong = errors.New("encrypted message is too long")
 )
 
 /*Default string values*/
 const (
-	illegalAddress = "unknown_address"
-	tag            = "Channel:"
+	tag = "Channel:"
 )
 
 /*
-sendTimeout after which the send is thrown away IF it isn't in progress (active
-data moving).
+maxChunkRetries is the number of consecutive transient failures to send a chunk
+after which the transfer is failed.
 */
-const sendTimeout = 10 * time.Second
+const maxChunkRetries = 100
+
+/*
+flushIterations is the number of times Tox is iterated after the shutdown hooks
+ran so that messages they sent can leave before Tox is killed.
+*/
+const flushIterations = 5
+
+/*
+unavailableAfter is the number of consecutive failed bootstrap rounds after
+which the network is considered unavailable and bootstrapping backs off.
+*/
+const unavailableAfter = 5
+
+/*
+maxBootstrapBackoff is the longest time between bootstrap rounds while the
+network is unavailable.
+*/
+const maxBootstrapBackoff = 10 * time.Minute
+
+/*
+maxTickAge is how long the background thread may go without iterating Tox
+before Health considers it stalled.
+*/
+const maxTickAge = 5 * time.Second
+
+/*
+stuckAfter is how long a running transfer may go without progress before Health
+considers it stuck.
+*/
+const stuckAfter = 1 * time.Minute
 
 /*
 State is an enumeration for notifying callbacks of transfer states.
@@ -62,3 +150,267 @@ func (s State) String() string {
 		return "unknown"
 	}
 }
+
+/*
+MessageType is an enumeration of the kinds of messages that can be received.
+*/
+type MessageType int
+
+const (
+	/*MsNormal is a normal text message.*/
+	MsNormal MessageType = iota
+	/*MsAction is an action message, equivalent to /me in chat clients.*/
+	MsAction
+)
+
+func (m MessageType) String() string {
+	switch m {
+	case MsNormal:
+		return "normal"
+	case MsAction:
+		return "action"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+Priority is an enumeration of the lanes queued messages can be sent on.
+*/
+type Priority int
+
+const (
+	/*PrBulk is used for messages that may wait behind file transfers.*/
+	PrBulk Priority = iota
+	/*PrHigh is used for small control messages that must never be starved.*/
+	PrHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrBulk:
+		return "bulk"
+	case PrHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+SyncPolicy is an enumeration of when received files are synced to disk.
+*/
+type SyncPolicy int
+
+const (
+	/*SpOnClose syncs the file once when the transfer is closed.*/
+	SpOnClose SyncPolicy = iota
+	/*SpPeriodic syncs the file every Options.SyncEvery bytes and on close.*/
+	SpPeriodic
+	/*SpNever leaves syncing to the operating system.*/
+	SpNever
+)
+
+func (s SyncPolicy) String() string {
+	switch s {
+	case SpOnClose:
+		return "on close"
+	case SpPeriodic:
+		return "periodic"
+	case SpNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+UserStatus is an enumeration of the presence a friend can publish in addition to
+being online or offline.
+*/
+type UserStatus int
+
+const (
+	/*UsNone means the friend is available.*/
+	UsNone UserStatus = iota
+	/*UsAway means the friend is away.*/
+	UsAway
+	/*UsBusy means the friend is busy.*/
+	UsBusy
+)
+
+func (u UserStatus) String() string {
+	switch u {
+	case UsNone:
+		return "none"
+	case UsAway:
+		return "away"
+	case UsBusy:
+		return "busy"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+ConnectionType is an enumeration of how a connection is established.
+*/
+type ConnectionType int
+
+const (
+	/*CtNone means there is no connection.*/
+	CtNone ConnectionType = iota
+	/*CtTCP means the connection is relayed via TCP.*/
+	CtTCP
+	/*CtUDP means the connection is direct via UDP.*/
+	CtUDP
+)
+
+func (c ConnectionType) String() string {
+	switch c {
+	case CtNone:
+		return "none"
+	case CtTCP:
+		return "tcp"
+	case CtUDP:
+		return "udp"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+ProxyType is an enumeration of the proxies Tox can connect through.
+*/
+type ProxyType int
+
+const (
+	/*PxNone means no proxy is used.*/
+	PxNone ProxyType = iota
+	/*PxHTTP is an HTTP proxy.*/
+	PxHTTP
+	/*PxSOCKS5 is a SOCKS5 proxy, for example Tor.*/
+	PxSOCKS5
+)
+
+func (p ProxyType) String() string {
+	switch p {
+	case PxNone:
+		return "none"
+	case PxHTTP:
+		return "http"
+	case PxSOCKS5:
+		return "socks5"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+AddressFamily is an enumeration of the IP versions the channel may use.
+*/
+type AddressFamily int
+
+const (
+	/*AfBoth uses IPv4 and IPv6.*/
+	AfBoth AddressFamily = iota
+	/*AfIPv4 uses only IPv4, for networks that misbehave with IPv6.*/
+	AfIPv4
+	/*AfIPv6 uses only IPv6.*/
+	AfIPv6
+)
+
+func (a AddressFamily) String() string {
+	switch a {
+	case AfBoth:
+		return "both"
+	case AfIPv4:
+		return "ipv4"
+	case AfIPv6:
+		return "ipv6"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+EventKind is an enumeration of the events sent on the Events channel.
+*/
+type EventKind int
+
+const (
+	/*EvFriendOnline is sent when a friend comes online.*/
+	EvFriendOnline EventKind = iota
+	/*EvFriendOffline is sent when a friend goes offline.*/
+	EvFriendOffline
+	/*EvSelfOnline is sent when the channel connects to the Tox network.*/
+	EvSelfOnline
+	/*EvSelfOffline is sent when the channel loses the Tox network.*/
+	EvSelfOffline
+	/*EvTransferDone is sent when a file transfer ends, successful or not.*/
+	EvTransferDone
+	/*EvNetworkUnavailable is sent when repeated bootstrap rounds all failed, for
+	example because there is no internet. Bootstrapping then backs off until the
+	channel is online again or Bootstrap is called.*/
+	EvNetworkUnavailable
+	/*EvFriendAdded is sent when an address has been added to the friend list.*/
+	EvFriendAdded
+	/*EvTransferStarted is sent when a file transfer starts, in either
+	direction.*/
+	EvTransferStarted
+)
+
+func (e EventKind) String() string {
+	switch e {
+	case EvFriendOnline:
+		return "friend online"
+	case EvFriendOffline:
+		return "friend offline"
+	case EvSelfOnline:
+		return "self online"
+	case EvSelfOffline:
+		return "self offline"
+	case EvTransferDone:
+		return "transfer done"
+	case EvNetworkUnavailable:
+		return "network unavailable"
+	case EvFriendAdded:
+		return "friend added"
+	case EvTransferStarted:
+		return "transfer started"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+LogLevel is an enumeration of the levels of log output, from most to least
+verbose.
+*/
+type LogLevel int32
+
+const (
+	/*LvDebug logs everything, including single chunks and packets.*/
+	LvDebug LogLevel = iota - 1
+	/*LvInfo logs regular events like coming online. It is the default.*/
+	LvInfo
+	/*LvWarn logs only problems.*/
+	LvWarn
+	/*LvError logs only failures.*/
+	LvError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LvDebug:
+		return "debug"
+	case LvInfo:
+		return "info"
+	case LvWarn:
+		return "warn"
+	case LvError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
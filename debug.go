@@ -0,0 +1,107 @@
+package channel
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+/*
+debugState is a snapshot of the internal state of a channel for bug reports.
+*/
+type debugState struct {
+	Time      time.Time               `json:"time"`
+	Online    string                  `json:"online"`
+	Paused    bool                    `json:"paused"`
+	Friends   []FriendInfo            `json:"friends"`
+	Transfers []debugTransfer         `json:"transfers"`
+	Queued    map[Address]int         `json:"queued"`
+	Active    map[Address]debugActive `json:"active"`
+	Parked    map[Address]int         `json:"parked"`
+	Incoming  []IncomingFile          `json:"incoming"`
+	Deferred  int                     `json:"deferred"`
+	Stats     Stats                   `json:"stats"`
+}
+
+/*
+debugTransfer describes a running transfer.
+*/
+type debugTransfer struct {
+	FileNumber uint32 `json:"file"`
+	Friend     uint32 `json:"friend"`
+	Path       string `json:"path"`
+	Name       string `json:"name"`
+	Size       uint64 `json:"size"`
+	Progress   uint64 `json:"progress"`
+	Done       bool   `json:"done"`
+}
+
+/*
+debugActive describes the send in progress of an address.
+*/
+type debugActive struct {
+	FileNumber uint32    `json:"file"`
+	Started    bool      `json:"started"`
+	Began      time.Time `json:"began"`
+}
+
+/*
+DebugDump returns the friends, queues, running transfers, and sends in progress
+of the channel as JSON, for attaching to bug reports. The state is taken by the
+background thread so that it is consistent.
+*/
+func (channel *Channel) DebugDump() ([]byte, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
+	reply := make(chan *debugState, 1)
+	select {
+	case channel.dumps <- reply:
+	case <-channel.stopped:
+		return nil, ErrClosed
+	}
+	return json.MarshalIndent(<-reply, "", "  ")
+}
+
+/*
+debugState takes a snapshot of the state. Must be called from the background
+thread.
+*/
+func (channel *Channel) debugState() *debugState {
+	state := &debugState{
+		Time:     time.Now().UTC(),
+		Online:   channel.connection().String(),
+		Paused:   channel.isPaused(),
+		Queued:   make(map[Address]int),
+		Active:   make(map[Address]debugActive),
+		Parked:   channel.parked.counts(),
+		Incoming: channel.incoming.list(),
+		Deferred: len(channel.deferred),
+		Stats:    channel.stats()}
+	state.Stats.TransfersActive = channel.transfers.count()
+	friends, err := channel.Friends()
+	if err != nil {
+		channel.logger.Warn("DebugDump:", err)
+	}
+	state.Friends = friends
+	for fileNumber, tran := range channel.transfers.all() {
+		state.Transfers = append(state.Transfers, debugTransfer{
+			FileNumber: fileNumber,
+			Friend:     tran.friend,
+			Path:       tran.path,
+			Name:       tran.name,
+			Size:       tran.size,
+			Progress:   atomic.LoadUint64(&tran.progress),
+			Done:       tran.isDone})
+	}
+	for address, queue := range channel.transfers.allQueues() {
+		state.Queued[address] = len(queue)
+		if sendTran, exists := channel.transfers.activeOf(address); exists {
+			state.Active[address] = debugActive{
+				FileNumber: sendTran.fileNumber,
+				Started:    sendTran.hasStarted(),
+				Began:      sendTran.began}
+		}
+	}
+	return state
+}
@@ -0,0 +1,152 @@
+package channel
+
+import (
+	"context"
+	"expvar"
+	"runtime/pprof"
+	"sync"
+)
+
+/*
+Subsystems the goroutines of a channel are labeled with for pprof.
+*/
+const (
+	subsystemRun       = "run"
+	subsystemCallbacks = "callbacks"
+	subsystemReadAhead = "readahead"
+	subsystemShutdown  = "shutdown"
+	subsystemFetch     = "fetch"
+)
+
+/*
+publishMut keeps two channels from publishing under the same expvar name.
+*/
+var publishMut sync.Mutex
+
+/*
+Diagnostics describes the goroutines and internal queues of a channel, so that
+profiles of a live peer can be attributed to its subsystems.
+*/
+type Diagnostics struct {
+	/*Goroutines counts the running goroutines of the channel by subsystem. In
+	pprof they carry the label tinzenite_channel with the subsystem and peer
+	with the start of the address the channel was created with.*/
+	Goroutines map[string]int
+	/*Running is the number of running transfers.*/
+	Running int
+	/*Queued is the number of transfers waiting to start.*/
+	Queued int
+	/*Parked is the number of transfers waiting for their friend.*/
+	Parked int
+	/*Incoming is the number of file offers awaiting a decision.*/
+	Incoming int
+	/*Deferred is the number of chunks held back by the rate limit.*/
+	Deferred int
+	/*Messages is the number of queued messages.*/
+	Messages int
+	/*Callbacks is the number of callbacks waiting for a worker.*/
+	Callbacks int
+}
+
+/*
+Diagnostics returns the goroutine counts and queue lengths of the channel. The
+queues are only counted while the channel is open.
+*/
+func (channel *Channel) Diagnostics() Diagnostics {
+	diagnostics := Diagnostics{
+		Goroutines: channel.routines.counts(),
+		Incoming:   len(channel.incoming.list()),
+		Callbacks:  channel.dispatcher.waiting()}
+	// the queues belong to the background thread
+	channel.do(func() {
+		diagnostics.Running = channel.transfers.count()
+		for _, queue := range channel.transfers.allQueues() {
+			diagnostics.Queued += len(queue)
+		}
+		for _, count := range channel.parked.counts() {
+			diagnostics.Parked += count
+		}
+		diagnostics.Deferred = len(channel.deferred)
+		diagnostics.Messages = channel.outbox.count()
+	})
+	return diagnostics
+}
+
+/*
+PublishExpvar publishes the Diagnostics of the channel with expvar under the
+given name, so that they are served on /debug/vars next to the profiles.
+*/
+func (channel *Channel) PublishExpvar(name string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	publishMut.Lock()
+	defer publishMut.Unlock()
+	if expvar.Get(name) != nil {
+		return ErrPublished
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return channel.Diagnostics()
+	}))
+	return nil
+}
+
+/*
+routines starts the goroutines of a channel with pprof labels and counts them by
+subsystem.
+*/
+type routines struct {
+	mutex   sync.Mutex
+	peer    string
+	running map[string]int
+}
+
+/*
+buildRoutines creates a routines for the channel of the given address.
+*/
+func buildRoutines(address Address) *routines {
+	peer := address.String()
+	if len(peer) > 8 {
+		peer = peer[:8]
+	}
+	return &routines{peer: peer, running: make(map[string]int)}
+}
+
+/*
+start runs f in a new goroutine labeled with the given subsystem.
+*/
+func (r *routines) start(subsystem string, f func()) {
+	r.mutex.Lock()
+	r.running[subsystem]++
+	r.mutex.Unlock()
+	labels := pprof.Labels("tinzenite_channel", subsystem, "peer", r.peer)
+	go pprof.Do(context.Background(), labels, func(context.Context) {
+		defer r.done(subsystem)
+		f()
+	})
+}
+
+/*
+done notes that a goroutine of the given subsystem returned.
+*/
+func (r *routines) done(subsystem string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running[subsystem]--
+	if r.running[subsystem] == 0 {
+		delete(r.running, subsystem)
+	}
+}
+
+/*
+counts returns the number of running goroutines by subsystem.
+*/
+func (r *routines) counts() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[string]int)
+	for subsystem, count := range r.running {
+		counts[subsystem] = count
+	}
+	return counts
+}
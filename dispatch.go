@@ -0,0 +1,157 @@
+package channel
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+/*
+dispatchQueue is the number of callbacks queued per worker before further
+callbacks are dropped.
+*/
+const dispatchQueue = 1024
+
+/*
+dispatcher runs callbacks on a fixed number of workers. All callbacks for the
+same address run on the same worker, so they are called in order.
+*/
+type dispatcher struct {
+	mutex   sync.RWMutex // protects closed from changing while dispatching
+	closed  bool
+	workers []*worker
+}
+
+/*
+worker runs the callbacks queued for it in order. A full queue drops callbacks
+instead of blocking, as the background thread dispatches them and callbacks may
+be waiting on it through public methods.
+*/
+type worker struct {
+	mutex  sync.Mutex
+	calls  []func()
+	closed bool      // set once no more calls are queued
+	wake   chan bool // signals queued calls or closing
+}
+
+/*
+buildDispatcher starts the given number of workers.
+*/
+func buildDispatcher(workers int, r *routines) *dispatcher {
+	d := &dispatcher{}
+	for i := 0; i < workers; i++ {
+		w := &worker{wake: make(chan bool, 1)}
+		d.workers = append(d.workers, w)
+		r.start(subsystemCallbacks, w.run)
+	}
+	return d
+}
+
+/*
+dispatch the given callback for the given address, which may be empty for
+events that don't belong to a friend. Never blocks. Returns false if the
+callback was dropped because the queue of its worker is full. Callbacks
+dispatched after stop are dropped silently.
+*/
+func (d *dispatcher) dispatch(address Address, call func()) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(address))
+	return d.workers[hash.Sum32()%uint32(len(d.workers))].push(call)
+}
+
+/*
+stop the workers once they have run all waiting callbacks.
+*/
+func (d *dispatcher) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	for _, w := range d.workers {
+		w.close()
+	}
+}
+
+/*
+waiting returns the number of callbacks waiting for a worker.
+*/
+func (d *dispatcher) waiting() int {
+	var waiting int
+	for _, w := range d.workers {
+		waiting += w.waiting()
+	}
+	return waiting
+}
+
+/*
+push queues a callback and wakes the worker. Returns false if the queue is full.
+*/
+func (w *worker) push(call func()) bool {
+	w.mutex.Lock()
+	if len(w.calls) >= dispatchQueue {
+		w.mutex.Unlock()
+		return false
+	}
+	w.calls = append(w.calls, call)
+	w.mutex.Unlock()
+	w.signal()
+	return true
+}
+
+/*
+close lets the worker return once it has run all queued callbacks.
+*/
+func (w *worker) close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+	w.signal()
+}
+
+/*
+signal wakes the worker without blocking.
+*/
+func (w *worker) signal() {
+	select {
+	case w.wake <- true:
+	default:
+	}
+}
+
+/*
+waiting returns the number of queued callbacks.
+*/
+func (w *worker) waiting() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.calls)
+}
+
+/*
+run the queued callbacks until closed.
+*/
+func (w *worker) run() {
+	for {
+		w.mutex.Lock()
+		calls := w.calls
+		w.calls = nil
+		closed := w.closed
+		w.mutex.Unlock()
+		for _, call := range calls {
+			call()
+		}
+		if len(calls) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+		<-w.wake
+	}
+}
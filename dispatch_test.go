@@ -0,0 +1,70 @@
+package channel
+
+import (
+	"sync"
+	"testing"
+)
+
+/*
+TestDispatchOrder checks that the callbacks of each address run in the order
+they were dispatched, and that stop runs all waiting callbacks first.
+*/
+func TestDispatchOrder(t *testing.T) {
+	d := buildDispatcher(4, buildRoutines(""))
+	addresses := []Address{"", "a", "b", "c", "d", "e"}
+	var mutex sync.Mutex
+	got := make(map[Address][]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		for _, address := range addresses {
+			address, i := address, i
+			wg.Add(1)
+			d.dispatch(address, func() {
+				defer wg.Done()
+				mutex.Lock()
+				got[address] = append(got[address], i)
+				mutex.Unlock()
+			})
+		}
+	}
+	d.stop()
+	wg.Wait()
+	for _, address := range addresses {
+		for i, value := range got[address] {
+			if value != i {
+				t.Fatalf("address %q: callback %d ran at position %d", address, value, i)
+			}
+		}
+	}
+}
+
+/*
+TestDispatchFull checks that a full worker drops callbacks instead of blocking.
+*/
+func TestDispatchFull(t *testing.T) {
+	d := buildDispatcher(1, buildRoutines(""))
+	defer d.stop()
+	started := make(chan bool)
+	release := make(chan bool)
+	d.dispatch("", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	tests := []struct {
+		name  string
+		count int
+		want  bool
+	}{
+		{"fill queue", dispatchQueue, true},
+		{"overflow", 1, false},
+	}
+	for _, test := range tests {
+		for i := 0; i < test.count; i++ {
+			if got := d.dispatch("", func() {}); got != test.want {
+				t.Fatalf("%s: dispatch returned %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+	close(release)
+}
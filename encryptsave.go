@@ -0,0 +1,109 @@
+package channel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+The format below is that of toxencryptsave, so encrypted profiles of other Tox
+clients can be opened: magic, salt, nonce, secretbox of the data. The key is
+derived with scrypt from the SHA-256 of the passphrase, with the parameters
+libsodium picks for the limits of toxencryptsave: OPSLIMIT_INTERACTIVE*2 and
+MEMLIMIT_INTERACTIVE.
+*/
+var encryptMagic = []byte("toxEsave")
+
+const (
+	encryptSaltLength  = 32
+	encryptNonceLength = 24
+	encryptScryptN     = 1 << 14
+	encryptScryptR     = 8
+	encryptScryptP     = 2
+)
+
+/*
+IsEncrypted returns whether the given ToxData is encrypted with a passphrase.
+*/
+func IsEncrypted(toxdata []byte) bool {
+	return bytes.HasPrefix(toxdata, encryptMagic)
+}
+
+/*
+EncryptToxData encrypts the given ToxData with the given passphrase in the
+toxencryptsave format.
+*/
+func EncryptToxData(toxdata []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, encryptSaltLength)
+	var nonce [encryptNonceLength]byte
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptMagic)+len(salt)+len(nonce)+secretbox.Overhead+len(toxdata))
+	out = append(out, encryptMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, toxdata, &nonce, key), nil
+}
+
+/*
+DecryptToxData decrypts ToxData encrypted with EncryptToxData or
+toxencryptsave.
+*/
+func DecryptToxData(toxdata []byte, passphrase string) ([]byte, error) {
+	header := len(encryptMagic) + encryptSaltLength + encryptNonceLength
+	if !IsEncrypted(toxdata) || len(toxdata) < header+secretbox.Overhead {
+		return nil, ErrNotEncrypted
+	}
+	salt := toxdata[len(encryptMagic) : len(encryptMagic)+encryptSaltLength]
+	var nonce [encryptNonceLength]byte
+	copy(nonce[:], toxdata[len(encryptMagic)+encryptSaltLength:header])
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := secretbox.Open(nil, toxdata[header:], &nonce, key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+	return data, nil
+}
+
+/*
+passphraseKey derives the encryption key from the passphrase and salt.
+*/
+func passphraseKey(passphrase string, salt []byte) (*[32]byte, error) {
+	hash := sha256.Sum256([]byte(passphrase))
+	derived, err := scrypt.Key(hash[:], salt, encryptScryptN, encryptScryptR, encryptScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+/*
+openToxData decrypts the given ToxData if it is encrypted, using the passphrase
+of the options.
+*/
+func (o Options) openToxData(toxdata []byte) ([]byte, error) {
+	if !IsEncrypted(toxdata) {
+		return toxdata, nil
+	}
+	if o.Passphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+	return DecryptToxData(toxdata, o.Passphrase)
+}
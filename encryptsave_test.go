@@ -0,0 +1,75 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+/*
+TestPassphraseKey checks the key derivation against a vector computed with
+libsodium's crypto_pwhash_scryptsalsa208sha256 and the limits of toxencryptsave.
+*/
+func TestPassphraseKey(t *testing.T) {
+	salt := make([]byte, encryptSaltLength)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	key, err := passphraseKey("correct horse battery staple", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a351cb77d86213eb547c4475a179e258286d88bb21f5b977c744f49c1b5dc137"
+	if got := hex.EncodeToString(key[:]); got != want {
+		t.Errorf("key is %s, want %s", got, want)
+	}
+}
+
+/*
+TestDecryptToxsave checks that data encrypted like libtoxencryptsave does, with
+libsodium's key derivation and crypto_secretbox_easy, can be decrypted.
+*/
+func TestDecryptToxsave(t *testing.T) {
+	encrypted, err := hex.DecodeString("746f784573617665" +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"6465666768696a6b6c6d6e6f707172737475767778797a7b" +
+		"65a9930a7edbd2c5eecc7f06ee56580a49ce8914c0baf511bc6940aa61a6132e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := DecryptToxData(encrypted, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "toxcore savedata"; string(data) != want {
+		t.Errorf("decrypted %q, want %q", data, want)
+	}
+}
+
+/*
+TestEncryptToxData checks that encrypted data can be decrypted again and only
+with the right passphrase.
+*/
+func TestEncryptToxData(t *testing.T) {
+	data := []byte("some tox data")
+	encrypted, err := EncryptToxData(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) {
+		t.Fatal("encrypted data is not recognized")
+	}
+	decrypted, err := DecryptToxData(encrypted, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("decrypted %q, want %q", decrypted, data)
+	}
+	if _, err := DecryptToxData(encrypted, "wrong"); err != ErrWrongPassphrase {
+		t.Errorf("wrong passphrase gave %v, want %v", err, ErrWrongPassphrase)
+	}
+	if _, err := DecryptToxData(data, "secret"); err != ErrNotEncrypted {
+		t.Errorf("plain data gave %v, want %v", err, ErrNotEncrypted)
+	}
+}
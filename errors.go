@@ -0,0 +1,34 @@
+package channel
+
+/*
+ToxError is an error reported by Tox, annotated with the Tox operation that
+failed. Use errors.As to inspect it.
+*/
+type ToxError struct {
+	Op  string // the Tox function that failed
+	Err error  // the error as returned by Tox
+}
+
+/*
+Error returns the failed operation along with the Tox error.
+*/
+func (e *ToxError) Error() string {
+	return "tox: " + e.Op + ": " + e.Err.Error()
+}
+
+/*
+Unwrap returns the error of Tox.
+*/
+func (e *ToxError) Unwrap() error {
+	return e.Err
+}
+
+/*
+toxErr wraps a non nil error of the given Tox operation in a ToxError.
+*/
+func toxErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ToxError{Op: op, Err: err}
+}
@@ -0,0 +1,161 @@
+package channel
+
+import "sync"
+
+/*
+eventBuffer is the number of events that are buffered for a slow consumer
+before further events are dropped.
+*/
+const eventBuffer = 64
+
+/*
+Event is sent on the Events channel. Only the fields relevant to the Kind are
+set.
+*/
+type Event struct {
+	/*Kind of the event.*/
+	Kind EventKind
+	/*Address of the friend, for friend and transfer events.*/
+	Address Address
+	/*Path of the file, for transfer events.*/
+	Path string
+	/*State a transfer ended with, for transfer events.*/
+	State State
+	/*Type of the connection, for online events.*/
+	Type ConnectionType
+}
+
+/*
+EventFilter selects the events a subscriber receives. A nil filter selects all
+events.
+*/
+type EventFilter func(event Event) bool
+
+/*
+FilterKinds returns a filter selecting only events of the given kinds.
+*/
+func FilterKinds(kinds ...EventKind) EventFilter {
+	return func(event Event) bool {
+		for _, kind := range kinds {
+			if event.Kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+/*
+subscriber is a single consumer of events.
+*/
+type subscriber struct {
+	filter EventFilter
+	queue  chan Event
+}
+
+/*
+events delivers events to all subscribers.
+*/
+type events struct {
+	mutex       sync.Mutex
+	subscribers map[*subscriber]bool
+	main        *subscriber // the subscriber of Events, nil until it is called
+}
+
+/*
+subscribe adds a subscriber with the given filter.
+*/
+func (e *events) subscribe(filter EventFilter) *subscriber {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.subscribers == nil {
+		e.subscribers = make(map[*subscriber]bool)
+	}
+	sub := &subscriber{filter: filter, queue: make(chan Event, eventBuffer)}
+	e.subscribers[sub] = true
+	return sub
+}
+
+/*
+unsubscribe removes the given subscriber and closes its channel.
+*/
+func (e *events) unsubscribe(sub *subscriber) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.subscribers[sub] {
+		return
+	}
+	delete(e.subscribers, sub)
+	close(sub.queue)
+}
+
+/*
+mainQueue returns the channel of Events, subscribing on the first call.
+*/
+func (e *events) mainQueue() <-chan Event {
+	e.mutex.Lock()
+	main := e.main
+	e.mutex.Unlock()
+	if main != nil {
+		return main.queue
+	}
+	main = e.subscribe(nil)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	// another call may have won the race
+	if e.main != nil {
+		delete(e.subscribers, main)
+		return e.main.queue
+	}
+	e.main = main
+	return main.queue
+}
+
+/*
+emit the given event to all subscribers whose filter selects it without
+blocking. Returns the number of subscribers that dropped the event because they
+don't keep up. The filters are user code and run without holding the mutex, so
+that a slow filter can't hold up subscribing and unsubscribing.
+*/
+func (e *events) emit(event Event) int {
+	e.mutex.Lock()
+	candidates := make([]*subscriber, 0, len(e.subscribers))
+	for sub := range e.subscribers {
+		candidates = append(candidates, sub)
+	}
+	e.mutex.Unlock()
+	var selected []*subscriber
+	for _, sub := range candidates {
+		if sub.filter == nil || sub.filter(event) {
+			selected = append(selected, sub)
+		}
+	}
+	if len(selected) == 0 {
+		return 0
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	dropped := 0
+	for _, sub := range selected {
+		// unsubscribed while filtering, so its queue is closed
+		if !e.subscribers[sub] {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+/*
+emit the given event, counting it for every subscriber that dropped it.
+*/
+func (channel *Channel) emit(event Event) {
+	channel.audit.write(event)
+	for i := channel.events.emit(event); i > 0; i-- {
+		inc(&channel.counters.droppedEvents)
+	}
+}
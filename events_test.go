@@ -0,0 +1,59 @@
+package channel
+
+import "testing"
+
+/*
+TestSubscribeFilter checks that each subscriber only receives the events its
+filter selects, and that a full subscriber drops events without holding up the
+others.
+*/
+func TestSubscribeFilter(t *testing.T) {
+	var e events
+	all := e.subscribe(nil)
+	online := e.subscribe(FilterKinds(EvSelfOnline, EvFriendOnline))
+	none := e.subscribe(FilterKinds())
+	emitted := []EventKind{EvSelfOnline, EvFriendAdded, EvFriendOnline, EvTransferDone}
+	for _, kind := range emitted {
+		if dropped := e.emit(Event{Kind: kind}); dropped != 0 {
+			t.Fatalf("%s: %d subscribers dropped the event", kind, dropped)
+		}
+	}
+	tests := []struct {
+		name string
+		sub  *subscriber
+		want []EventKind
+	}{
+		{"nil filter", all, emitted},
+		{"kinds", online, []EventKind{EvSelfOnline, EvFriendOnline}},
+		{"no kinds", none, nil},
+	}
+	for _, test := range tests {
+		if len(test.sub.queue) != len(test.want) {
+			t.Fatalf("%s: got %d events, want %d", test.name, len(test.sub.queue), len(test.want))
+		}
+		for _, kind := range test.want {
+			if got := <-test.sub.queue; got.Kind != kind {
+				t.Errorf("%s: got %s, want %s", test.name, got.Kind, kind)
+			}
+		}
+	}
+	e.unsubscribe(online)
+	if _, ok := <-online.queue; ok {
+		t.Error("unsubscribed queue is not closed")
+	}
+	// a subscriber that never reads only drops its own events
+	slow := e.subscribe(nil)
+	for i := 0; i < eventBuffer; i++ {
+		e.emit(Event{Kind: EvSelfOnline})
+		<-all.queue
+	}
+	if dropped := e.emit(Event{Kind: EvFriendOffline}); dropped != 1 {
+		t.Errorf("%d subscribers dropped the event, want only the full one", dropped)
+	}
+	if got := <-all.queue; got.Kind != EvFriendOffline {
+		t.Errorf("got %s, want %s", got.Kind, EvFriendOffline)
+	}
+	if len(slow.queue) != eventBuffer {
+		t.Errorf("full subscriber has %d events, want %d", len(slow.queue), eventBuffer)
+	}
+}
@@ -0,0 +1,42 @@
+package channel
+
+/*
+FriendInfo contains the details of a friend as returned by Friends.
+*/
+type FriendInfo struct {
+	Address        Address
+	Name           string
+	Alias          string
+	StatusMessage  string
+	Status         UserStatus
+	Online         bool
+	ConnectionType ConnectionType
+}
+
+/*
+Removal summarizes what was aborted when a connection was removed.
+*/
+type Removal struct {
+	/*Transfers is the number of active file transfers that were canceled.*/
+	Transfers int
+	/*Queued is the number of file transfers that were waiting to start.*/
+	Queued int
+	/*Parked is the number of file transfers that were waiting for the friend
+	to come online.*/
+	Parked int
+}
+
+/*
+exportedFriend is a single friend in the portable friend list of ExportFriends.
+*/
+type exportedFriend struct {
+	Address Address `json:"address"`
+	Alias   string  `json:"alias,omitempty"`
+}
+
+/*
+exportedFriends is the portable friend list of ExportFriends.
+*/
+type exportedFriends struct {
+	Friends []exportedFriend `json:"friends"`
+}
@@ -0,0 +1,80 @@
+package channel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+HealthReport summarizes whether a channel is working, so that supervisors can
+restart unhealthy peers.
+*/
+type HealthReport struct {
+	/*Healthy is true if the channel is online, its background thread is alive,
+	and no transfer is stuck. It is false while offline by GoOffline or
+	Suspend too; check Paused and Suspended to tell these apart.*/
+	Healthy bool
+	/*Connection of the channel to the Tox network.*/
+	Connection ConnectionType
+	/*Paused is true while the channel is offline by GoOffline.*/
+	Paused bool
+	/*Suspended is true while the background thread is parked by Suspend.*/
+	Suspended bool
+	/*LastBootstrap is when the channel last came online, zero if never.*/
+	LastBootstrap time.Time
+	/*TickAge is how long ago the background thread last iterated Tox.*/
+	TickAge time.Duration
+	/*Stalled is true if TickAge is too high for an active channel.*/
+	Stalled bool
+	/*StuckTransfers counts sends that were never accepted within their
+	timeout and running transfers without progress for a minute.*/
+	StuckTransfers int
+}
+
+/*
+Health returns a report on whether the channel is working.
+*/
+func (channel *Channel) Health() HealthReport {
+	report := HealthReport{
+		Connection: channel.connection(),
+		Paused:     channel.isPaused()}
+	channel.suspendMut.Lock()
+	report.Suspended = channel.resume != nil
+	channel.suspendMut.Unlock()
+	if at := atomic.LoadInt64(&channel.lastBootstrap); at != 0 {
+		report.LastBootstrap = time.Unix(0, at)
+	}
+	report.TickAge = time.Since(time.Unix(0, atomic.LoadInt64(&channel.lastTick)))
+	report.Stalled = !report.Suspended && report.TickAge > maxTickAge
+	// the transfers belong to the background thread, which may be the one stalled
+	stuck := make(chan int, 1)
+	select {
+	case channel.commands <- func() { stuck <- channel.stuckTransfers() }:
+		report.StuckTransfers = <-stuck
+	case <-channel.stopped:
+	case <-time.After(maxTickAge):
+	}
+	report.Healthy = !channel.isClosed() && report.Connection != CtNone && !report.Paused &&
+		!report.Suspended && !report.Stalled && report.StuckTransfers == 0
+	return report
+}
+
+/*
+stuckTransfers counts the sends that were never accepted within their timeout
+and the running transfers without progress. Must be called from the background
+thread.
+*/
+func (channel *Channel) stuckTransfers() int {
+	var stuck int
+	for _, tran := range channel.transfers.all() {
+		if tran.stalled(stuckAfter) {
+			stuck++
+		}
+	}
+	for address := range channel.transfers.allQueues() {
+		if sendTran, exists := channel.transfers.activeOf(address); exists && sendTran.isStale() {
+			stuck++
+		}
+	}
+	return stuck
+}
@@ -0,0 +1,115 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Bucket bounds of the histograms.
+*/
+var (
+	// durationBuckets in seconds, from 100µs to 10s
+	durationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+	// throughputBuckets in bytes per second, from 1 KiB/s to 100 MiB/s
+	throughputBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+)
+
+/*
+Histogram is a snapshot of a distribution of values.
+*/
+type Histogram struct {
+	/*Bounds are the upper bounds of the buckets, ascending.*/
+	Bounds []float64
+	/*Counts are the number of values at most the bound of the same index,
+	cumulative like Prometheus buckets. Values above all bounds are only
+	counted in Count.*/
+	Counts []uint64
+	/*Sum of all values.*/
+	Sum float64
+	/*Count of all values.*/
+	Count uint64
+}
+
+/*
+histogram records values into fixed buckets.
+*/
+type histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64 // not cumulative
+	sum    float64
+	count  uint64
+}
+
+/*
+buildHistogram creates an empty histogram with the given bucket bounds.
+*/
+func buildHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+/*
+observe records a value.
+*/
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for index, bound := range h.bounds {
+		if value <= bound {
+			h.counts[index]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+/*
+observeSince records the time since the given start in seconds.
+*/
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+/*
+snapshot of the histogram.
+*/
+func (h *histogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	snap := Histogram{
+		Bounds: append([]float64(nil), h.bounds...),
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    h.sum,
+		Count:  h.count}
+	var total uint64
+	for index, count := range h.counts {
+		total += count
+		snap.Counts[index] = total
+	}
+	return snap
+}
+
+/*
+timings are the distributions behind the histograms of Stats.
+*/
+type timings struct {
+	chunkService *histogram // chunk request until the chunk was handed to Tox
+	diskRead     *histogram // reading a chunk to send
+	diskWrite    *histogram // writing a received chunk
+	toxSend      *histogram // handing a chunk to Tox
+	throughput   *histogram // bytes per second of successful transfers
+}
+
+/*
+buildTimings creates empty distributions.
+*/
+func buildTimings() *timings {
+	return &timings{
+		chunkService: buildHistogram(durationBuckets),
+		diskRead:     buildHistogram(durationBuckets),
+		diskWrite:    buildHistogram(durationBuckets),
+		toxSend:      buildHistogram(durationBuckets),
+		throughput:   buildHistogram(throughputBuckets)}
+}
@@ -0,0 +1,123 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+IncomingFile is a file offer of a friend that awaits a decision.
+*/
+type IncomingFile struct {
+	ID      uint64
+	Address Address
+	Name    string
+	Size    uint64
+	friend  uint32
+	file    uint32
+	expires time.Time
+}
+
+/*
+incoming parks the file offers that have not been accepted or rejected yet.
+*/
+type incoming struct {
+	mutex  sync.Mutex
+	next   uint64
+	offers map[uint64]IncomingFile
+}
+
+/*
+add an offer that expires after the given time to live, returning the id it is
+parked under.
+*/
+func (in *incoming) add(offer IncomingFile, ttl time.Duration) uint64 {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	if in.offers == nil {
+		in.offers = make(map[uint64]IncomingFile)
+	}
+	in.next++
+	offer.ID = in.next
+	offer.expires = time.Now().Add(ttl)
+	in.offers[offer.ID] = offer
+	return offer.ID
+}
+
+/*
+take removes and returns the offer of the given id.
+*/
+func (in *incoming) take(id uint64) (IncomingFile, bool) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	offer, exists := in.offers[id]
+	delete(in.offers, id)
+	return offer, exists
+}
+
+/*
+removeFile drops the offer of the given transfer, returning whether it existed.
+*/
+func (in *incoming) removeFile(friend, file uint32) bool {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	for id, offer := range in.offers {
+		if offer.friend == friend && offer.file == file {
+			delete(in.offers, id)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+removeFriend drops all offers of the given friend.
+*/
+func (in *incoming) removeFriend(friend uint32) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	for id, offer := range in.offers {
+		if offer.friend == friend {
+			delete(in.offers, id)
+		}
+	}
+}
+
+/*
+expired removes and returns all offers whose time to live has run out.
+*/
+func (in *incoming) expired() []IncomingFile {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	var expired []IncomingFile
+	now := time.Now()
+	for id, offer := range in.offers {
+		if now.After(offer.expires) {
+			expired = append(expired, offer)
+			delete(in.offers, id)
+		}
+	}
+	return expired
+}
+
+/*
+list returns all parked offers.
+*/
+func (in *incoming) list() []IncomingFile {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	var list []IncomingFile
+	for _, offer := range in.offers {
+		list = append(list, offer)
+	}
+	return list
+}
+
+/*
+clear drops all offers.
+*/
+func (in *incoming) clear() {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	in.offers = nil
+}
@@ -0,0 +1,86 @@
+package channel
+
+/*
+outgoing is a queued message waiting to be sent.
+*/
+type outgoing struct {
+	friend  uint32
+	message string
+}
+
+/*
+lanes hold the queued outgoing messages by priority. High priority messages are
+always sent before any file chunks or bulk messages. Owned by the background
+thread.
+*/
+type lanes struct {
+	high []outgoing
+	bulk []outgoing
+}
+
+/*
+push a message onto the lane for the given priority.
+*/
+func (l *lanes) push(message outgoing, priority Priority) {
+	if priority == PrHigh {
+		l.high = append(l.high, message)
+	} else {
+		l.bulk = append(l.bulk, message)
+	}
+}
+
+/*
+peek returns the next message of the given priority without removing it.
+*/
+func (l *lanes) peek(priority Priority) (outgoing, bool) {
+	lane := l.bulk
+	if priority == PrHigh {
+		lane = l.high
+	}
+	if len(lane) == 0 {
+		return outgoing{}, false
+	}
+	return lane[0], true
+}
+
+/*
+pop removes the next message of the given priority.
+*/
+func (l *lanes) pop(priority Priority) {
+	if priority == PrHigh {
+		if len(l.high) > 0 {
+			l.high = l.high[1:]
+		}
+	} else if len(l.bulk) > 0 {
+		l.bulk = l.bulk[1:]
+	}
+}
+
+/*
+hasHigh returns true if high priority messages are waiting.
+*/
+func (l *lanes) hasHigh() bool {
+	return len(l.high) > 0
+}
+
+/*
+empty returns true if no messages are waiting in either lane.
+*/
+func (l *lanes) empty() bool {
+	return len(l.high) == 0 && len(l.bulk) == 0
+}
+
+/*
+count returns the number of queued messages.
+*/
+func (l *lanes) count() int {
+	return len(l.high) + len(l.bulk)
+}
+
+/*
+clear drops all waiting messages.
+*/
+func (l *lanes) clear() {
+	l.high = nil
+	l.bulk = nil
+}
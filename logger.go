@@ -0,0 +1,107 @@
+package channel
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+/*
+Logger receives all log output of a channel. Set it in the options to route the
+output into the logging of the application.
+*/
+type Logger interface {
+	/*Debug is for verbose output that is only of interest when debugging.*/
+	Debug(v ...interface{})
+	/*Info is for regular events like coming online.*/
+	Info(v ...interface{})
+	/*Warn is for problems the channel recovers from.*/
+	Warn(v ...interface{})
+	/*Error is for failures that lose data or functionality.*/
+	Error(v ...interface{})
+}
+
+/*
+stdLogger is the default Logger. It writes to the standard log package.
+*/
+type stdLogger struct{}
+
+/*Debug logs with the channel tag and a debug marker.*/
+func (stdLogger) Debug(v ...interface{}) {
+	log.Println(append([]interface{}{tag, "DEBUG:"}, v...)...)
+}
+
+/*Info logs with the channel tag.*/
+func (stdLogger) Info(v ...interface{}) {
+	log.Println(append([]interface{}{tag}, v...)...)
+}
+
+/*Warn logs with the channel tag and a warning marker.*/
+func (stdLogger) Warn(v ...interface{}) {
+	log.Println(append([]interface{}{tag, "WARNING:"}, v...)...)
+}
+
+/*Error logs with the channel tag and an error marker.*/
+func (stdLogger) Error(v ...interface{}) {
+	log.Println(append([]interface{}{tag, "ERROR:"}, v...)...)
+}
+
+/*
+levelLogger passes only output of at least its level on to a Logger. The level
+can be changed at any time.
+*/
+type levelLogger struct {
+	level  int32 // LogLevel, accessed atomically
+	logger Logger
+}
+
+/*
+buildLevelLogger wraps the given logger, which may be nil for the default one.
+*/
+func buildLevelLogger(logger Logger, level LogLevel) *levelLogger {
+	if logger == nil {
+		logger = stdLogger{}
+	}
+	return &levelLogger{level: int32(level), logger: logger}
+}
+
+/*
+setLevel of the logger.
+*/
+func (l *levelLogger) setLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+/*
+enabled returns whether output of the given level is passed on.
+*/
+func (l *levelLogger) enabled(level LogLevel) bool {
+	return LogLevel(atomic.LoadInt32(&l.level)) <= level
+}
+
+/*Debug passes on if enabled.*/
+func (l *levelLogger) Debug(v ...interface{}) {
+	if l.enabled(LvDebug) {
+		l.logger.Debug(v...)
+	}
+}
+
+/*Info passes on if enabled.*/
+func (l *levelLogger) Info(v ...interface{}) {
+	if l.enabled(LvInfo) {
+		l.logger.Info(v...)
+	}
+}
+
+/*Warn passes on if enabled.*/
+func (l *levelLogger) Warn(v ...interface{}) {
+	if l.enabled(LvWarn) {
+		l.logger.Warn(v...)
+	}
+}
+
+/*Error passes on if enabled.*/
+func (l *levelLogger) Error(v ...interface{}) {
+	if l.enabled(LvError) {
+		l.logger.Error(v...)
+	}
+}
@@ -0,0 +1,39 @@
+package channel
+
+import (
+	"context"
+	"time"
+)
+
+/*
+loopbackTimeout bounds how long NewLoopbackPair waits for the pair to connect.
+*/
+const loopbackTimeout = time.Second
+
+/*
+NewLoopbackPair returns two channels that are connected to each other without
+the Tox network, for end to end tests of consumers. Both are online and see the
+other as an online friend when it returns. Callbacks can be set with
+SetCallbacks; Tox is iterated every millisecond so that tests run quickly.
+*/
+func NewLoopbackPair() (*Channel, *Channel, error) {
+	options := DefaultOptions()
+	options.IterateInterval = time.Millisecond
+	options.MinIterateInterval = time.Millisecond
+	options.MaxIterateInterval = 5 * time.Millisecond
+	first, second, err := CreateMemoryPair(nil, nil, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), loopbackTimeout)
+	defer cancel()
+	for _, channel := range []*Channel{first, second} {
+		err = channel.WaitUntilOnline(ctx)
+		if err != nil {
+			first.Close()
+			second.Close()
+			return nil, nil, err
+		}
+	}
+	return first, second, nil
+}
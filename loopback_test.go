@@ -0,0 +1,210 @@
+package channel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+testTimeout bounds how long the end to end tests wait for anything to arrive.
+*/
+const testTimeout = 10 * time.Second
+
+/*
+loopbackPair creates a connected pair of channels and the address of each as
+seen by the other. The caller must close both channels.
+*/
+func loopbackPair(t *testing.T) (*Channel, *Channel, Address, Address) {
+	first, second, err := NewLoopbackPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstAddress, err := first.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondAddress, err := second.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second, firstAddress, secondAddress
+}
+
+/*
+TestLoopbackMessage checks that a message arrives unchanged at the other side.
+*/
+func TestLoopbackMessage(t *testing.T) {
+	first, second, firstAddress, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	type received struct {
+		address Address
+		message string
+	}
+	messages := make(chan received, 1)
+	second.OnMessageFunc(func(address Address, message string, kind MessageType) {
+		messages <- received{address, message}
+	})
+	if err := first.Send(secondAddress, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-messages:
+		if got.address != firstAddress || got.message != "hello" {
+			t.Errorf("received %q from %s, want %q from %s", got.message, got.address, "hello", firstAddress)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("message did not arrive")
+	}
+}
+
+/*
+TestLoopbackFileTransfer checks that a file spanning many chunks arrives
+completely and that both sides report success.
+*/
+func TestLoopbackFileTransfer(t *testing.T) {
+	first, second, _, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	dir, err := ioutil.TempDir("", "channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 300*1024+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	second.OnAllowFileFunc(func(address Address, name string) (bool, string) {
+		return name == "file", target
+	})
+	received := make(chan string, 1)
+	second.OnFileReceivedFunc(func(address Address, path, name string) {
+		received <- path
+	})
+	states := make(chan State, 1)
+	if err := first.SendFile(secondAddress, source, "file", func(status State) { states <- status }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case path := <-received:
+		if path != target {
+			t.Errorf("received to %s, want %s", path, target)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("file was not received")
+	}
+	select {
+	case state := <-states:
+		if state != StSuccess {
+			t.Errorf("sending finished with %s", state)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("sending did not finish")
+	}
+	written, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("received %d bytes that differ from the %d sent", len(written), len(data))
+	}
+}
+
+/*
+TestLoopbackCallbackReply checks that callbacks can reply from within while
+many messages are queued, which must neither deadlock nor lose messages.
+*/
+func TestLoopbackCallbackReply(t *testing.T) {
+	first, second, firstAddress, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	const count = 2000
+	second.OnMessageFunc(func(address Address, message string, kind MessageType) {
+		if err := second.Send(address, "re: "+message); err != nil {
+			t.Error(err)
+		}
+	})
+	replies := make(chan string, count)
+	first.OnMessageFunc(func(address Address, message string, kind MessageType) {
+		replies <- message
+	})
+	for i := 0; i < count; i++ {
+		if err := first.SendQueued(secondAddress, fmt.Sprint(i), PrBulk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]bool)
+	deadline := time.After(testTimeout)
+	for len(seen) < count {
+		select {
+		case reply := <-replies:
+			seen[reply] = true
+		case <-deadline:
+			t.Fatalf("only %d of %d replies arrived at %s", len(seen), count, firstAddress)
+		}
+	}
+	for i := 0; i < count; i++ {
+		if !seen["re: "+fmt.Sprint(i)] {
+			t.Errorf("reply to %d is missing", i)
+		}
+	}
+}
+
+/*
+TestLoopbackStream checks that more data than fits the buffer of the reader is
+delivered completely and in order, the writer waiting for the reader.
+*/
+func TestLoopbackStream(t *testing.T) {
+	first, second, firstAddress, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	data := make([]byte, 3*streamBuffer+5)
+	rand.New(rand.NewSource(2)).Read(data)
+	writer, err := first.OpenStream(secondAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		written <- err
+	}()
+	// wait for the stream to appear on the other side before reading it
+	var reader io.ReadWriteCloser
+	deadline := time.Now().Add(testTimeout)
+	for reader == nil {
+		second.streamMut.Lock()
+		if s, exists := second.streams[firstAddress]; exists {
+			reader = s
+		}
+		second.streamMut.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	read, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("read %d bytes that differ from the %d written", len(read), len(data))
+	}
+}
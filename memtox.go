@@ -0,0 +1,765 @@
+package channel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/codedust/go-tox"
+)
+
+const (
+	// memoryChunkSize is the size of the chunks requested, as in Tox
+	memoryChunkSize = toxChunkSize
+	// memoryWindow is the number of chunks requested ahead of the sent ones
+	memoryWindow = 64
+	// memoryInterval is the iteration interval of the backend in milliseconds
+	memoryInterval = 1
+	// memoryIncoming shifts the file numbers of the peer, as Tox does for received files
+	memoryIncoming = 16
+)
+
+/*
+CreateMemoryPair creates two channels that are each other's only friend and
+talk over an in memory backend instead of the Tox network. Chunk requests and
+receipts are generated as Tox would, so that the queueing, scheduling and file
+I/O paths can be benchmarked without the network. The pair is online at once;
+bootstrapping, adding or removing friends and restarting are not supported.
+*/
+func CreateMemoryPair(callbacksA, callbacksB Callbacks, options *Options) (*Channel, *Channel, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	// there is no network to check
+	memoryOptions := *options
+	memoryOptions.RequireMinNodes = false
+	toxA, toxB := buildMemoryPair()
+	first, err := createWithTox(toxA, callbacksA, &memoryOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	second, err := createWithTox(toxB, callbacksB, &memoryOptions)
+	if err != nil {
+		first.Close()
+		return nil, nil, err
+	}
+	return first, second, nil
+}
+
+/*
+memoryFile is a file that is being sent over the in memory backend.
+*/
+type memoryFile struct {
+	size      uint64
+	requested uint64 // position up to which chunks have been requested
+	sent      uint64 // bytes that have been sent
+	resumed   bool   // set while the receiver wants chunks
+}
+
+/*
+memoryTox is one side of an in memory backend. The other side is always
+friend 0. Everything sent is delivered on the next Iterate of the peer.
+*/
+type memoryTox struct {
+	mutex         sync.Mutex
+	peer          *memoryTox
+	publicKey     []byte
+	nospam        uint32
+	name          string
+	statusMessage string
+	online        bool                   // set once the connection callbacks have run
+	connected     bool                   // whether the peer is reachable, see setConnected
+	killed        bool                   // set by Kill
+	pending       []func()               // callbacks to run on the next Iterate
+	nextFile      uint32                 // file number of the next file sent
+	nextMessage   uint32                 // id of the next message sent
+	sends         map[uint32]*memoryFile // files being sent by file number
+	// callbacks, only those that the backend can trigger
+	onFriendRequest    gotox.CallbackFriendRequest
+	onSelfConnection   gotox.CallbackSelfConnectionStatusChanges
+	onFriendConnection gotox.CallbackFriendConnectionStatusChanges
+	onMessage          gotox.CallbackFriendMessage
+	onReadReceipt      gotox.CallbackFriendReadReceipt
+	onFileRecv         gotox.CallbackFileRecv
+	onFileRecvControl  gotox.CallbackFileRecvControl
+	onFileRecvChunk    gotox.CallbackFileRecvChunk
+	onChunkRequest     gotox.CallbackFileChunkRequest
+	onLossyPacket      gotox.CallbackFriendLossyPacket
+	onLosslessPacket   gotox.CallbackFriendLosslessPacket
+}
+
+/*
+buildMemoryPair creates two backends that are connected to each other.
+*/
+func buildMemoryPair() (*memoryTox, *memoryTox) {
+	first := buildMemoryTox()
+	second := buildMemoryTox()
+	first.peer = second
+	second.peer = first
+	return first, second
+}
+
+/*
+buildMemoryTox creates a single backend with a random identity.
+*/
+func buildMemoryTox() *memoryTox {
+	key := make([]byte, publicKeySize)
+	rand.Read(key)
+	nospam := make([]byte, nospamSize)
+	rand.Read(nospam)
+	return &memoryTox{
+		publicKey:     key,
+		nospam:        binary.BigEndian.Uint32(nospam),
+		statusMessage: "Tinzenite Peer",
+		connected:     true,
+		sends:         make(map[uint32]*memoryFile)}
+}
+
+/*
+post queues a callback to be run on the next Iterate.
+*/
+func (m *memoryTox) post(call func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.killed {
+		return
+	}
+	m.pending = append(m.pending, call)
+}
+
+/*
+checkFriend returns an error for every friend but the peer.
+*/
+func (m *memoryTox) checkFriend(friendnumber uint32) error {
+	if friendnumber != 0 {
+		return ErrLostAddress
+	}
+	return nil
+}
+
+/*
+checkSend returns an error unless the friend is the peer and reachable.
+*/
+func (m *memoryTox) checkSend(friendnumber uint32) error {
+	if err := m.checkFriend(friendnumber); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.connected {
+		return ErrOffline
+	}
+	return nil
+}
+
+/*
+setConnected connects or disconnects both sides of the pair, running the friend
+connection callbacks on their next Iterate. As in Tox all files being sent are
+dropped on disconnect.
+*/
+func (m *memoryTox) setConnected(connected bool) {
+	status := gotox.TOX_CONNECTION_NONE
+	if connected {
+		status = gotox.TOX_CONNECTION_UDP
+	}
+	for _, side := range []*memoryTox{m, m.peer} {
+		side.mutex.Lock()
+		changed := side.connected != connected
+		side.connected = connected
+		if !connected {
+			side.sends = make(map[uint32]*memoryFile)
+		}
+		side.mutex.Unlock()
+		if !changed {
+			continue
+		}
+		side := side
+		side.post(func() {
+			if side.onFriendConnection != nil {
+				side.onFriendConnection(nil, 0, status)
+			}
+		})
+	}
+}
+
+/*
+receiveRequest runs the friend request callback on the next Iterate as if the
+given key had sent a request.
+*/
+func (m *memoryTox) receiveRequest(publickey []byte, message string) {
+	m.post(func() {
+		if m.onFriendRequest != nil {
+			m.onFriendRequest(nil, publickey, message)
+		}
+	})
+}
+
+/*
+Iterate runs all queued callbacks and requests the next chunks of the files
+being sent. Callbacks are run without holding the lock as they call back into
+the backend.
+*/
+func (m *memoryTox) Iterate() error {
+	m.mutex.Lock()
+	if m.killed {
+		m.mutex.Unlock()
+		return nil
+	}
+	var calls []func()
+	if !m.online {
+		m.online = true
+		connected := m.connected
+		// the peer first, so that it is known once we are online
+		calls = append(calls, func() {
+			if m.onFriendConnection != nil && connected {
+				m.onFriendConnection(nil, 0, gotox.TOX_CONNECTION_UDP)
+			}
+			if m.onSelfConnection != nil {
+				m.onSelfConnection(nil, gotox.TOX_CONNECTION_UDP)
+			}
+		})
+	}
+	calls = append(calls, m.pending...)
+	m.pending = nil
+	for number, file := range m.sends {
+		calls = append(calls, m.requestChunks(number, file)...)
+	}
+	m.mutex.Unlock()
+	for _, call := range calls {
+		call()
+	}
+	return nil
+}
+
+/*
+requestChunks returns the chunk requests for the given file, keeping at most
+memoryWindow chunks outstanding. Once everything has been sent the final empty
+request is returned and the file is done. Must be called with the lock held.
+*/
+func (m *memoryTox) requestChunks(number uint32, file *memoryFile) []func() {
+	if !file.resumed {
+		return nil
+	}
+	var calls []func()
+	request := func(position, length uint64) {
+		calls = append(calls, func() {
+			if m.onChunkRequest != nil {
+				m.onChunkRequest(nil, 0, number, position, length)
+			}
+		})
+	}
+	for file.requested < file.size && file.requested-file.sent < memoryWindow*memoryChunkSize {
+		length := file.size - file.requested
+		if length > memoryChunkSize {
+			length = memoryChunkSize
+		}
+		request(file.requested, length)
+		file.requested += length
+	}
+	if file.sent >= file.size {
+		request(file.size, 0)
+		delete(m.sends, number)
+		peer := m.peer
+		incoming := (number + 1) << memoryIncoming
+		size := file.size
+		peer.post(func() {
+			if peer.onFileRecvChunk != nil {
+				peer.onFileRecvChunk(nil, 0, incoming, size, nil)
+			}
+		})
+	}
+	return calls
+}
+
+/*
+Kill stops the backend; nothing is delivered to it anymore.
+*/
+func (m *memoryTox) Kill() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.killed = true
+	m.pending = nil
+	return nil
+}
+
+/*
+GetSavedata returns no data as there is nothing to persist.
+*/
+func (m *memoryTox) GetSavedata() ([]byte, error) {
+	return nil, nil
+}
+
+/*
+Bootstrap does nothing as the backend is always online.
+*/
+func (m *memoryTox) Bootstrap(address string, port uint16, publickey []byte) error {
+	return nil
+}
+
+/*
+AddTcpRelay does nothing as the backend is always online.
+*/
+func (m *memoryTox) AddTcpRelay(address string, port uint16, publickey []byte) error {
+	return nil
+}
+
+/*
+IterationInterval returns memoryInterval.
+*/
+func (m *memoryTox) IterationInterval() (int64, error) {
+	return memoryInterval, nil
+}
+
+/*
+SelfGetConnectionStatus returns UDP once the backend has been iterated.
+*/
+func (m *memoryTox) SelfGetConnectionStatus() (gotox.ToxConnection, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.online {
+		return gotox.TOX_CONNECTION_NONE, nil
+	}
+	return gotox.TOX_CONNECTION_UDP, nil
+}
+
+/*
+SelfGetAddress returns the full Tox ID of the backend.
+*/
+func (m *memoryTox) SelfGetAddress() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	id := make([]byte, toxIDSize)
+	copy(id, m.publicKey)
+	binary.BigEndian.PutUint32(id[publicKeySize:], m.nospam)
+	checksum := toxChecksum(id[:publicKeySize+nospamSize])
+	copy(id[publicKeySize+nospamSize:], checksum[:])
+	return id, nil
+}
+
+/*
+SelfSetNospam sets the nospam of the Tox ID.
+*/
+func (m *memoryTox) SelfSetNospam(nospam uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nospam = nospam
+	return nil
+}
+
+/*
+SelfGetNospam returns the nospam of the Tox ID.
+*/
+func (m *memoryTox) SelfGetNospam() (uint32, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.nospam, nil
+}
+
+/*
+SelfSetName sets the name the peer sees.
+*/
+func (m *memoryTox) SelfSetName(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.name = name
+	return nil
+}
+
+/*
+SelfGetName returns the name.
+*/
+func (m *memoryTox) SelfGetName() (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.name, nil
+}
+
+/*
+SelfSetStatusMessage sets the status message the peer sees.
+*/
+func (m *memoryTox) SelfSetStatusMessage(status string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.statusMessage = status
+	return nil
+}
+
+/*
+SelfGetStatusMessage returns the status message.
+*/
+func (m *memoryTox) SelfGetStatusMessage() (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.statusMessage, nil
+}
+
+/*
+SelfSetStatus does nothing as the status is always none.
+*/
+func (m *memoryTox) SelfSetStatus(userstatus gotox.ToxUserStatus) error {
+	return nil
+}
+
+/*
+SelfGetFriendlist returns the peer as the only friend.
+*/
+func (m *memoryTox) SelfGetFriendlist() ([]uint32, error) {
+	return []uint32{0}, nil
+}
+
+/*
+SelfGetDhtID returns the public key as there is no DHT.
+*/
+func (m *memoryTox) SelfGetDhtID() ([]byte, error) {
+	return m.publicKey, nil
+}
+
+/*
+SelfGetUDPPort returns 0 as no port is bound.
+*/
+func (m *memoryTox) SelfGetUDPPort() (uint16, error) {
+	return 0, nil
+}
+
+/*
+SelfGetTCPPort returns 0 as no port is bound.
+*/
+func (m *memoryTox) SelfGetTCPPort() (uint16, error) {
+	return 0, nil
+}
+
+/*
+FriendAdd is not supported as the friend list is fixed.
+*/
+func (m *memoryTox) FriendAdd(address []byte, message string) (uint32, error) {
+	return 0, ErrNotSupported
+}
+
+/*
+FriendAddNorequest is not supported as the friend list is fixed.
+*/
+func (m *memoryTox) FriendAddNorequest(publickey []byte) (uint32, error) {
+	return 0, ErrNotSupported
+}
+
+/*
+FriendDelete is not supported as the friend list is fixed.
+*/
+func (m *memoryTox) FriendDelete(friendnumber uint32) error {
+	return ErrNotSupported
+}
+
+/*
+FriendByPublicKey returns 0 for the key of the peer.
+*/
+func (m *memoryTox) FriendByPublicKey(publickey []byte) (uint32, error) {
+	if !bytes.Equal(publickey, m.peer.publicKey) {
+		return 0, ErrLostAddress
+	}
+	return 0, nil
+}
+
+/*
+FriendGetPublickey returns the key of the peer.
+*/
+func (m *memoryTox) FriendGetPublickey(friendnumber uint32) ([]byte, error) {
+	if err := m.checkFriend(friendnumber); err != nil {
+		return nil, err
+	}
+	return m.peer.publicKey, nil
+}
+
+/*
+FriendGetLastOnline returns now as the peer is always online.
+*/
+func (m *memoryTox) FriendGetLastOnline(friendnumber uint32) (time.Time, error) {
+	if err := m.checkFriend(friendnumber); err != nil {
+		return time.Time{}, err
+	}
+	return time.Now(), nil
+}
+
+/*
+FriendGetName returns the name of the peer.
+*/
+func (m *memoryTox) FriendGetName(friendnumber uint32) (string, error) {
+	if err := m.checkFriend(friendnumber); err != nil {
+		return "", err
+	}
+	return m.peer.SelfGetName()
+}
+
+/*
+FriendGetStatusMessage returns the status message of the peer.
+*/
+func (m *memoryTox) FriendGetStatusMessage(friendnumber uint32) (string, error) {
+	if err := m.checkFriend(friendnumber); err != nil {
+		return "", err
+	}
+	return m.peer.SelfGetStatusMessage()
+}
+
+/*
+FriendGetStatus returns none as the status never changes.
+*/
+func (m *memoryTox) FriendGetStatus(friendnumber uint32) (gotox.ToxUserStatus, error) {
+	return gotox.TOX_USERSTATUS_NONE, m.checkFriend(friendnumber)
+}
+
+/*
+FriendGetConnectionStatus returns UDP while the peer is reachable.
+*/
+func (m *memoryTox) FriendGetConnectionStatus(friendnumber uint32) (gotox.ToxConnection, error) {
+	if err := m.checkSend(friendnumber); err != nil {
+		return gotox.TOX_CONNECTION_NONE, m.checkFriend(friendnumber)
+	}
+	return gotox.TOX_CONNECTION_UDP, nil
+}
+
+/*
+FriendGetTyping returns false as the peer never types.
+*/
+func (m *memoryTox) FriendGetTyping(friendnumber uint32) (bool, error) {
+	return false, m.checkFriend(friendnumber)
+}
+
+/*
+FriendSendMessage delivers the message to the peer, which answers with a read
+receipt once it has been handled.
+*/
+func (m *memoryTox) FriendSendMessage(friendnumber uint32, messagetype gotox.ToxMessageType, message string) (uint32, error) {
+	if err := m.checkSend(friendnumber); err != nil {
+		return 0, err
+	}
+	m.mutex.Lock()
+	id := m.nextMessage
+	m.nextMessage++
+	m.mutex.Unlock()
+	peer := m.peer
+	peer.post(func() {
+		if peer.onMessage != nil {
+			peer.onMessage(nil, 0, messagetype, message)
+		}
+		m.post(func() {
+			if m.onReadReceipt != nil {
+				m.onReadReceipt(nil, 0, id)
+			}
+		})
+	})
+	return id, nil
+}
+
+/*
+FriendSendLossyPacket delivers the packet to the peer.
+*/
+func (m *memoryTox) FriendSendLossyPacket(friendnumber uint32, data []byte) error {
+	if err := m.checkSend(friendnumber); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	peer := m.peer
+	peer.post(func() {
+		if peer.onLossyPacket != nil {
+			peer.onLossyPacket(nil, 0, data)
+		}
+	})
+	return nil
+}
+
+/*
+FriendSendLosslessPacket delivers the packet to the peer.
+*/
+func (m *memoryTox) FriendSendLosslessPacket(friendnumber uint32, data []byte) error {
+	if err := m.checkSend(friendnumber); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	peer := m.peer
+	peer.post(func() {
+		if peer.onLosslessPacket != nil {
+			peer.onLosslessPacket(nil, 0, data)
+		}
+	})
+	return nil
+}
+
+/*
+FileControl applies the control to the file and forwards it to the peer. Files
+received from the peer have their number shifted by memoryIncoming.
+*/
+func (m *memoryTox) FileControl(friendnumber uint32, filenumber uint32, filecontrol gotox.ToxFileControl) error {
+	if err := m.checkSend(friendnumber); err != nil {
+		return err
+	}
+	sender, number, forwarded := m, filenumber, (filenumber+1)<<memoryIncoming
+	if filenumber >= 1<<memoryIncoming {
+		sender, number, forwarded = m.peer, filenumber>>memoryIncoming-1, filenumber>>memoryIncoming-1
+	}
+	sender.mutex.Lock()
+	file, exists := sender.sends[number]
+	if exists {
+		switch filecontrol {
+		case gotox.TOX_FILE_CONTROL_RESUME:
+			file.resumed = true
+		case gotox.TOX_FILE_CONTROL_PAUSE:
+			file.resumed = false
+		case gotox.TOX_FILE_CONTROL_CANCEL:
+			delete(sender.sends, number)
+		}
+	}
+	sender.mutex.Unlock()
+	if !exists {
+		return ErrTransferNotFound
+	}
+	peer := m.peer
+	peer.post(func() {
+		if peer.onFileRecvControl != nil {
+			peer.onFileRecvControl(nil, 0, forwarded, filecontrol)
+		}
+	})
+	return nil
+}
+
+/*
+FileSend offers a file to the peer. Chunks are requested once the peer resumes
+the transfer.
+*/
+func (m *memoryTox) FileSend(friendnumber uint32, kind gotox.ToxFileKind, filesize uint64, fileid []byte, filename string) (uint32, error) {
+	if err := m.checkSend(friendnumber); err != nil {
+		return 0, err
+	}
+	m.mutex.Lock()
+	number := m.nextFile
+	m.nextFile++
+	m.sends[number] = &memoryFile{size: filesize}
+	m.mutex.Unlock()
+	peer := m.peer
+	peer.post(func() {
+		if peer.onFileRecv != nil {
+			peer.onFileRecv(nil, 0, (number+1)<<memoryIncoming, kind, filesize, filename)
+		}
+	})
+	return number, nil
+}
+
+/*
+FileSendChunk delivers a requested chunk to the peer.
+*/
+func (m *memoryTox) FileSendChunk(friendnumber uint32, filenumber uint32, position uint64, data []byte) error {
+	if err := m.checkSend(friendnumber); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	file, exists := m.sends[filenumber]
+	if exists {
+		file.sent += uint64(len(data))
+	}
+	m.mutex.Unlock()
+	if !exists {
+		return ErrTransferNotFound
+	}
+	data = append([]byte(nil), data...)
+	peer := m.peer
+	peer.post(func() {
+		if peer.onFileRecvChunk != nil {
+			peer.onFileRecvChunk(nil, 0, (filenumber+1)<<memoryIncoming, position, data)
+		}
+	})
+	return nil
+}
+
+/*
+CallbackFriendRequest sets the callback for friend requests, see receiveRequest.
+*/
+func (m *memoryTox) CallbackFriendRequest(f gotox.CallbackFriendRequest) {
+	m.onFriendRequest = f
+}
+
+/*
+CallbackFriendMessage sets the callback for messages.
+*/
+func (m *memoryTox) CallbackFriendMessage(f gotox.CallbackFriendMessage) {
+	m.onMessage = f
+}
+
+/*
+CallbackFriendNameChanges does nothing as names are only read.
+*/
+func (m *memoryTox) CallbackFriendNameChanges(f gotox.CallbackFriendNameChanges) {}
+
+/*
+CallbackFriendStatusMessageChanges does nothing as status messages are only
+read.
+*/
+func (m *memoryTox) CallbackFriendStatusMessageChanges(f gotox.CallbackFriendStatusMessageChanges) {}
+
+/*
+CallbackFriendStatusChanges does nothing as the status never changes.
+*/
+func (m *memoryTox) CallbackFriendStatusChanges(f gotox.CallbackFriendStatusChanges) {}
+
+/*
+CallbackFriendConnectionStatusChanges sets the callback run when the peer comes
+online.
+*/
+func (m *memoryTox) CallbackFriendConnectionStatusChanges(f gotox.CallbackFriendConnectionStatusChanges) {
+	m.onFriendConnection = f
+}
+
+/*
+CallbackFriendReadReceipt sets the callback for read receipts.
+*/
+func (m *memoryTox) CallbackFriendReadReceipt(f gotox.CallbackFriendReadReceipt) {
+	m.onReadReceipt = f
+}
+
+/*
+CallbackSelfConnectionStatusChanges sets the callback run when coming online.
+*/
+func (m *memoryTox) CallbackSelfConnectionStatusChanges(f gotox.CallbackSelfConnectionStatusChanges) {
+	m.onSelfConnection = f
+}
+
+/*
+CallbackFileRecvControl sets the callback for file controls of the peer.
+*/
+func (m *memoryTox) CallbackFileRecvControl(f gotox.CallbackFileRecvControl) {
+	m.onFileRecvControl = f
+}
+
+/*
+CallbackFileRecv sets the callback for file offers of the peer.
+*/
+func (m *memoryTox) CallbackFileRecv(f gotox.CallbackFileRecv) {
+	m.onFileRecv = f
+}
+
+/*
+CallbackFileRecvChunk sets the callback for received chunks.
+*/
+func (m *memoryTox) CallbackFileRecvChunk(f gotox.CallbackFileRecvChunk) {
+	m.onFileRecvChunk = f
+}
+
+/*
+CallbackFileChunkRequest sets the callback for chunk requests.
+*/
+func (m *memoryTox) CallbackFileChunkRequest(f gotox.CallbackFileChunkRequest) {
+	m.onChunkRequest = f
+}
+
+/*
+CallbackFriendLossyPacket sets the callback for lossy packets.
+*/
+func (m *memoryTox) CallbackFriendLossyPacket(f gotox.CallbackFriendLossyPacket) {
+	m.onLossyPacket = f
+}
+
+/*
+CallbackFriendLosslessPacket sets the callback for lossless packets.
+*/
+func (m *memoryTox) CallbackFriendLosslessPacket(f gotox.CallbackFriendLosslessPacket) {
+	m.onLosslessPacket = f
+}
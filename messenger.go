@@ -0,0 +1,128 @@
+package channel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+Messenger is the method set of Channel. Consumers should depend on it instead of
+*Channel so that they can inject a mock in their tests without a live Tox
+instance.
+*/
+type Messenger interface {
+	// lifecycle
+	Close()
+	CloseWithContext(ctx context.Context) error
+	CloseGraceful(timeout time.Duration) ([]byte, error)
+	OnShutdown(hook func())
+	Restart() error
+	LoadToxData(toxdata []byte) error
+	ToxData() ([]byte, error)
+	// network
+	Suspend()
+	Resume()
+	GoOffline()
+	GoOnline()
+	Bootstrap(ctx context.Context) error
+	SetBootstrapNodes(nodes []Node)
+	IsOnline() (bool, error)
+	WaitUntilOnline(ctx context.Context) error
+	UDPPort() (uint16, error)
+	TCPPort() (uint16, error)
+	DHTKey() (string, error)
+	// identity
+	ConnectionAddress() (string, error)
+	Address() (Address, error)
+	SelfSetNospam(nospam uint32) error
+	SelfGetNospam() (uint32, error)
+	SelfSetName(name string) error
+	SelfName() (string, error)
+	SelfSetStatusMessage(message string) error
+	SelfStatusMessage() (string, error)
+	// friends
+	OnlineAddresses() ([]Address, error)
+	FriendAddresses() ([]Address, error)
+	Friends() ([]FriendInfo, error)
+	ExportFriends() ([]byte, error)
+	ImportFriends(data []byte) error
+	SetAlias(address Address, alias string) error
+	AliasOf(address Address) (string, error)
+	SetPeerMeta(address Address, key, value string) error
+	PeerMeta(address Address, key string) (string, error)
+	AcceptConnection(address Address) error
+	PendingRequests() []FriendRequest
+	AcceptRequest(address Address) error
+	RejectRequest(address Address) error
+	RequestConnection(id, message string) error
+	RequestConnectionWithContext(ctx context.Context, id, message string) error
+	CancelRequest(address Address) error
+	RemoveConnection(address Address) (Removal, error)
+	FriendCount() (int, error)
+	FriendCapacity() (int, error)
+	IsFriend(address Address) (bool, error)
+	IsAddressOnline(address Address) (bool, error)
+	ConnectionTypeOf(address Address) (ConnectionType, error)
+	FullAddressOf(address Address) (string, error)
+	IsTyping(address Address) (bool, error)
+	NameOf(address Address) (string, error)
+	StatusOf(address Address) (UserStatus, error)
+	LastSeen(address Address) (time.Time, error)
+	Block(address Address) error
+	Unblock(address Address) error
+	Blocked() []Address
+	// messaging
+	Send(address Address, message string) error
+	SendWithContext(ctx context.Context, address Address, message string) error
+	SendReliable(ctx context.Context, address Address, message string) error
+	SendQueued(address Address, message string, priority Priority) error
+	OpenStream(address Address) (io.ReadWriteCloser, error)
+	Ping(ctx context.Context, address Address) (time.Duration, error)
+	LastPong(address Address) (time.Duration, time.Time, error)
+	SetRateLimit(bytesPerSecond uint64)
+	SetCipher(cipher Cipher)
+	// files
+	SendFile(address Address, path string, identification string, f func(status State)) error
+	SendFileWithContext(ctx context.Context, address Address, path string, identification string, f func(status State)) error
+	SendFileWithTimeout(address Address, path string, identification string, timeout time.Duration, f func(status State)) error
+	CancelFileTransfer(path string) error
+	PendingIncoming() []IncomingFile
+	AcceptIncoming(id uint64, path string) error
+	AcceptIncomingWithSync(id uint64, path string, policy SyncPolicy) error
+	RejectIncoming(id uint64) error
+	ActiveTransfers() map[string]int
+	// events and callbacks
+	Events() <-chan Event
+	Subscribe(filter EventFilter) (<-chan Event, func())
+	SetCallbacks(callbacks Callbacks)
+	OnFriendRequestFunc(f func(address Address, message string))
+	OnMessageFunc(f func(address Address, message string, kind MessageType))
+	OnAllowFileFunc(f func(address Address, name string) (bool, string))
+	OnFileReceivedFunc(f func(address Address, path, name string))
+	OnFileCanceledFunc(f func(address Address, path string))
+	OnConnectedFunc(f func(address Address, kind ConnectionType))
+	OnFriendAddedFunc(f func(address Address))
+	OnFriendListChangedFunc(f func())
+	OnStatusChangeFunc(f func(address Address, status UserStatus))
+	OnNameChangeFunc(f func(address Address, name string))
+	OnStatusMessageChangeFunc(f func(address Address, message string))
+	OnConnectionTypeChangedFunc(f func(address Address, kind ConnectionType))
+	OnNetworkStatusFunc(f func(online bool, nodes []Node))
+	OnSelfConnectionStatusFunc(f func(kind ConnectionType))
+	// diagnostics
+	SetLogLevel(level LogLevel)
+	Stats() Stats
+	PeerStats(address Address) (PeerStats, error)
+	MetricsHandler() http.Handler
+	DebugDump() ([]byte, error)
+	Health() HealthReport
+	Diagnostics() Diagnostics
+	PublishExpvar(name string) error
+}
+
+/*
+Channel must always implement Messenger.
+*/
+var _ Messenger = (*Channel)(nil)
@@ -0,0 +1,91 @@
+package channel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/*
+metricsPrefix is prepended to the names of all exported metrics.
+*/
+const metricsPrefix = "tinzenite_channel_"
+
+/*
+metric is a single value in the Prometheus text format.
+*/
+type metric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value float64
+}
+
+/*
+MetricsHandler returns an HTTP handler that exposes the Stats of the channel in
+the Prometheus text format. Nothing is collected unless it is served, for
+example with http.Handle("/metrics", channel.MetricsHandler()).
+*/
+func (channel *Channel) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if channel.isClosed() {
+			http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, channel.Stats())
+	})
+}
+
+/*
+writeMetrics writes the given stats in the Prometheus text format.
+*/
+func writeMetrics(w io.Writer, stats Stats) {
+	online := 0.0
+	if stats.Connection != CtNone {
+		online = 1
+	}
+	metrics := []metric{
+		{"messages_sent_total", "counter", "Messages handed to Tox.", float64(stats.MessagesSent)},
+		{"messages_received_total", "counter", "Messages received from friends.", float64(stats.MessagesReceived)},
+		{"transfers_active", "gauge", "File transfers currently running.", float64(stats.TransfersActive)},
+		{"transfers_completed_total", "counter", "File transfers that finished successfully.", float64(stats.TransfersCompleted)},
+		{"transfers_failed_total", "counter", "File transfers that failed.", float64(stats.TransfersFailed)},
+		{"transfers_timed_out_total", "counter", "File transfers that timed out.", float64(stats.TransfersTimedOut)},
+		{"transfers_canceled_total", "counter", "File transfers canceled by either side.", float64(stats.TransfersCanceled)},
+		{"bytes_sent_total", "counter", "File data sent in bytes.", float64(stats.BytesSent)},
+		{"bytes_received_total", "counter", "File data received in bytes.", float64(stats.BytesReceived)},
+		{"bootstrap_attempts_total", "counter", "Nodes bootstrapped to.", float64(stats.BootstrapAttempts)},
+		{"bootstrap_successes_total", "counter", "Nodes that accepted the bootstrap request.", float64(stats.BootstrapSuccesses)},
+		{"friends_online", "gauge", "Friends currently online.", float64(stats.FriendsOnline)},
+		{"reconnects_total", "counter", "Times the channel came back online.", float64(stats.Reconnects)},
+		{"uptime_seconds", "gauge", "Time since the channel was created.", stats.Uptime.Seconds()},
+		{"online", "gauge", "Whether the channel is connected to the Tox network.", online},
+		{"dropped_events_total", "counter", "Events dropped because nobody handled them.", float64(stats.DroppedEvents)},
+		{"chunk_retries_total", "counter", "File chunks retried after a transient error.", float64(stats.ChunkRetries)},
+		{"chunk_failures_total", "counter", "File chunks that failed their transfer.", float64(stats.ChunkFailures)}}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, m.name, m.kind)
+		fmt.Fprintf(w, "%s%s %g\n", metricsPrefix, m.name, m.value)
+	}
+	writeHistogram(w, "chunk_service_seconds", "Time from a chunk request until the chunk was sent.", stats.ChunkService)
+	writeHistogram(w, "disk_read_seconds", "Time spent reading chunks to send.", stats.DiskRead)
+	writeHistogram(w, "disk_write_seconds", "Time spent writing received chunks.", stats.DiskWrite)
+	writeHistogram(w, "tox_send_seconds", "Time spent handing chunks to Tox.", stats.ToxSend)
+	writeHistogram(w, "transfer_throughput_bytes_per_second", "Throughput of successful transfers.", stats.Throughput)
+}
+
+/*
+writeHistogram writes the given histogram in the Prometheus text format.
+*/
+func writeHistogram(w io.Writer, name, help string, h Histogram) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(w, "# TYPE %s%s histogram\n", metricsPrefix, name)
+	for index, bound := range h.Bounds {
+		fmt.Fprintf(w, "%s%s_bucket{le=\"%g\"} %d\n", metricsPrefix, name, bound, h.Counts[index])
+	}
+	fmt.Fprintf(w, "%s%s_bucket{le=\"+Inf\"} %d\n", metricsPrefix, name, h.Count)
+	fmt.Fprintf(w, "%s%s_sum %g\n", metricsPrefix, name, h.Sum)
+	fmt.Fprintf(w, "%s%s_count %d\n", metricsPrefix, name, h.Count)
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package channel
+
+import "os"
+
+/*
+mapFile is not supported on this platform, so files are always read.
+*/
+func mapFile(file *os.File, size uint64) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+/*
+unmapFile does nothing as nothing is ever mapped.
+*/
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package channel
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+mapFile maps the given file read only into memory.
+*/
+func mapFile(file *os.File, size uint64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+/*
+unmapFile releases memory returned by mapFile.
+*/
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,43 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package channel
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+/*
+TestMappedTruncated checks that reading a mapped file that is truncated while
+it is sent fails with ErrFileTruncated instead of crashing.
+*/
+func TestMappedTruncated(t *testing.T) {
+	file, err := ioutil.TempFile("", "channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size := uint64(4 * os.Getpagesize())
+	if err := file.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := mapFile(file, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmapFile(mapped)
+	tran := &transfer{file: file, mapped: mapped}
+	data := make([]byte, 1024)
+	if err := tran.readChunk(size-uint64(len(data)), data); err != nil {
+		t.Fatalf("reading before truncating: %v", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tran.readChunk(size-uint64(len(data)), data); err != ErrFileTruncated {
+		t.Errorf("reading after truncating gave %v, want %v", err, ErrFileTruncated)
+	}
+}
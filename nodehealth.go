@@ -0,0 +1,104 @@
+package channel
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+nodeHealth is the bootstrap history of a single node. It is persisted with the
+ToxData so that good nodes are preferred across runs.
+*/
+type nodeHealth struct {
+	Successes int           `json:"successes"`
+	Failures  int           `json:"failures"`
+	Latency   time.Duration `json:"latency"` // average time from bootstrap until online
+}
+
+/*
+score of the node between 0 and 1. Unknown nodes score 0.5 so that they are
+tried before nodes that consistently fail.
+*/
+func (h *nodeHealth) score() float64 {
+	if h == nil {
+		return 0.5
+	}
+	return float64(h.Successes+1) / float64(h.Successes+h.Failures+2)
+}
+
+/*
+nodeSucceeded records that bootstrapping to the node with the given public key
+brought the channel online after the given latency.
+*/
+func (s *sidecar) nodeSucceeded(key string, latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	health := s.health(key)
+	if health.Latency == 0 {
+		health.Latency = latency
+	} else {
+		// moving average so that old measurements fade out
+		health.Latency = (3*health.Latency + latency) / 4
+	}
+	health.Successes++
+}
+
+/*
+nodeFailed records a failed bootstrap to the node with the given public key.
+*/
+func (s *sidecar) nodeFailed(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.health(key).Failures++
+}
+
+/*
+keepNodes drops the history of all nodes not in the given list, so that it
+doesn't grow with every node that was ever fetched.
+*/
+func (s *sidecar) keepNodes(nodes []Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	known := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		known[node.PublicKey] = true
+	}
+	for key := range s.Nodes {
+		if !known[key] {
+			delete(s.Nodes, key)
+		}
+	}
+}
+
+/*
+health returns the health of the given node, creating it. Must be called with
+the mutex held.
+*/
+func (s *sidecar) health(key string) *nodeHealth {
+	health, exists := s.Nodes[key]
+	if !exists {
+		health = &nodeHealth{}
+		s.Nodes[key] = health
+	}
+	return health
+}
+
+/*
+rankNodes sorts the given nodes from best to worst: by score first, then by
+latency. Nodes that compare equal keep their order.
+*/
+func (s *sidecar) rankNodes(nodes []Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a := s.Nodes[nodes[i].PublicKey]
+		b := s.Nodes[nodes[j].PublicKey]
+		if a.score() != b.score() {
+			return a.score() > b.score()
+		}
+		if a == nil || b == nil || a.Latency == 0 || b.Latency == 0 {
+			return false
+		}
+		return a.Latency < b.Latency
+	})
+}
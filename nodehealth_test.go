@@ -0,0 +1,56 @@
+package channel
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestNodeScore checks that unknown nodes score in between nodes that succeed and
+nodes that fail.
+*/
+func TestNodeScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		health *nodeHealth
+		want   float64
+	}{
+		{"unknown", nil, 0.5},
+		{"no history", &nodeHealth{}, 0.5},
+		{"succeeding", &nodeHealth{Successes: 3}, 0.8},
+		{"failing", &nodeHealth{Failures: 2}, 0.25},
+		{"mixed", &nodeHealth{Successes: 1, Failures: 1}, 0.5},
+	}
+	for _, test := range tests {
+		if got := test.health.score(); got != test.want {
+			t.Errorf("%s: score %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+/*
+TestRankNodes checks that nodes are ranked by score, then by latency, and that
+nodes that compare equal keep their order.
+*/
+func TestRankNodes(t *testing.T) {
+	s := buildSidecar()
+	s.nodeFailed("failing")
+	s.nodeSucceeded("slow", 2*time.Second)
+	s.nodeSucceeded("fast", time.Second)
+	s.nodeSucceeded("flaky", time.Millisecond)
+	s.nodeFailed("flaky")
+	nodes := []Node{
+		{PublicKey: "failing"},
+		{PublicKey: "unknown1"},
+		{PublicKey: "slow"},
+		{PublicKey: "flaky"},
+		{PublicKey: "unknown2"},
+		{PublicKey: "fast"}}
+	s.rankNodes(nodes)
+	want := []string{"fast", "slow", "unknown1", "flaky", "unknown2", "failing"}
+	for i, node := range nodes {
+		if node.PublicKey != want[i] {
+			t.Fatalf("rank %d is %s, want %s", i, node.PublicKey, want[i])
+		}
+	}
+}
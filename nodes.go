@@ -0,0 +1,470 @@
+package channel
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/xamino/tox-dynboot"
+)
+
+/*
+bootstrapPerRound is the number of nodes that are bootstrapped to per round.
+*/
+const bootstrapPerRound = 4
+
+/*
+Node is a Tox bootstrap node.
+*/
+type Node struct {
+	/*Address is the IPv4 address or host name of the node.*/
+	Address string
+	/*AddressIPv6 is the IPv6 address of the node, if it has one.*/
+	AddressIPv6 string
+	/*Port is the UDP port of the node.*/
+	Port uint16
+	/*PublicKey is the hex encoded DHT public key of the node.*/
+	PublicKey string
+	/*TCPPorts are the ports on which the node offers a TCP relay, if any.*/
+	TCPPorts []uint16
+}
+
+/*
+fallbackNodes are well known, long running bootstrap nodes that are used if
+neither tox-dynboot nor the node cache provide any. The list is a snapshot of
+nodes.tox.chat and should be updated now and then. It only has IPv4 addresses,
+so it is of no use with AfIPv6. It never counts towards MinNodes.
+*/
+var fallbackNodes = []Node{
+	{Address: "tox.abilinski.com", Port: 33445, PublicKey: "10c00eb250c3233e343e2aeba07115a5c28920e9c8d29492f6d00b29049edc7e", TCPPorts: []uint16{33445}},
+	{Address: "tox.kurnevsky.net", Port: 33445, PublicKey: "82ef82ba33445a1f91a7db27189ecfc0c013e06e3da71f588ed692bed625ec23", TCPPorts: []uint16{33445}},
+	{Address: "tox.initramfs.io", Port: 33445, PublicKey: "3f0a45a268367c1bea652f258c85f4a66da76bcaa667a49e770bcc4917ab6a25", TCPPorts: []uint16{3389, 33445}},
+	{Address: "205.185.115.131", Port: 53, PublicKey: "3091c6beb2a993f1c6300c16549faba67098ff3d62c6d253828b531470b53d68", TCPPorts: []uint16{443, 3389, 33445}},
+	{Address: "144.217.167.73", Port: 33445, PublicKey: "7e5668e0ee09e19f320ad47902419331ffee147bb3606769cfbe921a2a2fd34c", TCPPorts: []uint16{3389, 33445}}}
+
+/*
+nodesOf converts the nodes fetched by toxdynboot to our nodes.
+*/
+func nodesOf(toxNodes []toxdynboot.ToxNode) []Node {
+	var nodes []Node
+	for _, node := range toxNodes {
+		converted := Node{
+			Address:     node.IPv4,
+			AddressIPv6: node.IPv6,
+			Port:        node.Port,
+			PublicKey:   hex.EncodeToString(node.PublicKey)}
+		if node.TCPStatus {
+			converted.TCPPorts = node.TCPPorts
+		}
+		nodes = append(nodes, converted)
+	}
+	return nodes
+}
+
+/*
+fetchNodes fetches the currently alive bootstrap nodes unless the caller has
+supplied their own. Returns the number of nodes that were supplied or fetched,
+not counting the cached or built-in ones used if the fetch failed. Blocks for up
+to NodeFetchTimeout, so it must not be called from the background thread.
+*/
+func (channel *Channel) fetchNodes() int {
+	// a given backend has no network to bootstrap to
+	if channel.custom {
+		return 0
+	}
+	if nodes := channel.bootstrapNodes(); len(nodes) > 0 {
+		return len(nodes)
+	}
+	nodes := channel.downloadNodes()
+	channel.useNodes(nodes)
+	return len(nodes)
+}
+
+/*
+fetchNodesLater fetches the currently alive bootstrap nodes in the background
+unless the caller has supplied their own. The background thread receives them
+from the fetched channel.
+*/
+func (channel *Channel) fetchNodesLater() {
+	if len(channel.bootstrapNodes()) > 0 {
+		return
+	}
+	channel.refetchNodes()
+}
+
+/*
+refetchNodes fetches the currently alive bootstrap nodes in the background,
+even if some are already known. Does nothing if a fetch is already running.
+*/
+func (channel *Channel) refetchNodes() {
+	// a given backend has no network to bootstrap to
+	if channel.custom || channel.fetching {
+		return
+	}
+	channel.fetching = true
+	channel.routines.start(subsystemFetch, func() {
+		channel.fetched <- channel.downloadNodes()
+	})
+}
+
+/*
+downloadNodes fetches the currently alive bootstrap nodes from the network,
+blocking for up to NodeFetchTimeout.
+*/
+func (channel *Channel) downloadNodes() []Node {
+	toxNodes, err := toxdynboot.FetchAlive(channel.options.NodeFetchTimeout)
+	if err != nil {
+		channel.logger.Warn("Fetching ToxNodes for Tox failed!", err)
+	}
+	return nodesOf(toxNodes)
+}
+
+/*
+useNodes replaces the bootstrap nodes with the fetched ones, falling back to the
+node cache and then the built-in nodes if none were fetched, and keeping the
+current ones if nothing better is available.
+*/
+func (channel *Channel) useNodes(nodes []Node) {
+	if len(nodes) > 0 {
+		channel.writeNodeCache(nodes)
+	} else {
+		nodes = channel.readNodeCache()
+	}
+	// warn if too few ToxNodes (even 0), the built-in ones don't count
+	if len(nodes) < channel.options.MinNodes {
+		channel.logger.Warn("Too few ToxNodes!", len(nodes), "ToxNodes found.")
+	}
+	if len(nodes) == 0 && len(channel.bootstrapNodes()) == 0 {
+		if channel.options.AddressFamily == AfIPv6 {
+			channel.logger.Warn("No ToxNodes found and the built-in ones have no IPv6 address, can't bootstrap with AfIPv6!")
+		} else {
+			channel.logger.Warn("No ToxNodes found, using", len(fallbackNodes), "built-in ToxNodes.")
+			nodes = fallbackNodes
+		}
+	}
+	if len(nodes) == 0 && len(channel.bootstrapNodes()) > 0 {
+		return
+	}
+	channel.SetBootstrapNodes(nodes)
+}
+
+/*
+writeNodeCache writes the given nodes to the node cache file, if one is set.
+*/
+func (channel *Channel) writeNodeCache(nodes []Node) {
+	path := channel.options.NodeCachePath
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		channel.logger.Error("Encoding node cache failed:", err)
+		return
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		channel.logger.Error("Writing node cache failed:", err)
+	}
+}
+
+/*
+readNodeCache reads the nodes from the node cache file, if one is set and exists.
+*/
+func (channel *Channel) readNodeCache() []Node {
+	path := channel.options.NodeCachePath
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		channel.logger.Warn("Reading node cache failed:", err)
+		return nil
+	}
+	var nodes []Node
+	err = json.Unmarshal(data, &nodes)
+	if err != nil {
+		channel.logger.Error("Decoding node cache failed:", err)
+		return nil
+	}
+	channel.logger.Info("Using", len(nodes), "cached ToxNodes.")
+	return nodes
+}
+
+/*
+bootstrapNodes returns the current list of bootstrap nodes.
+*/
+func (channel *Channel) bootstrapNodes() []Node {
+	channel.nodeMut.Lock()
+	defer channel.nodeMut.Unlock()
+	return channel.nodes
+}
+
+/*
+bootstrapInterval returns the jittered time until the next bootstrap check: fast
+until the channel was online for the first time, slow afterwards. While the
+network is unavailable the interval is doubled for every further failed round.
+*/
+func (channel *Channel) bootstrapInterval() time.Duration {
+	interval := channel.options.FastBootstrapInterval
+	if channel.everOnline {
+		interval = channel.options.BootstrapInterval
+	}
+	for i := unavailableAfter; i <= channel.bootFailures && interval < maxBootstrapBackoff; i++ {
+		interval *= 2
+	}
+	if interval > maxBootstrapBackoff {
+		interval = maxBootstrapBackoff
+	}
+	return jitter(interval, channel.options.Jitter)
+}
+
+/*
+checkOnline polls the connection of the channel. This catches changes Tox
+doesn't report, like pausing with GoOffline.
+*/
+func (channel *Channel) checkOnline() {
+	kind := CtNone
+	if !channel.isPaused() {
+		status, err := channel.tox.SelfGetConnectionStatus()
+		if err != nil {
+			return
+		}
+		kind = connectionTypeOf(status)
+	}
+	channel.selfConnectionChanged(kind)
+}
+
+/*
+connection returns the connection of the channel at the last check.
+*/
+func (channel *Channel) connection() ConnectionType {
+	return ConnectionType(atomic.LoadInt32(&channel.selfType))
+}
+
+/*
+selfConnectionChanged notifies the callbacks if the connection of the channel
+changed.
+*/
+func (channel *Channel) selfConnectionChanged(kind ConnectionType) {
+	if kind == channel.connection() {
+		return
+	}
+	atomic.StoreInt32(&channel.selfType, int32(kind))
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch("", func() { channel.handler().OnSelfConnectionStatus(kind) })
+	online := kind != CtNone
+	if online == channel.online {
+		return
+	}
+	channel.online = online
+	if online {
+		atomic.StoreInt64(&channel.lastBootstrap, time.Now().UnixNano())
+		if channel.everOnline {
+			inc(&channel.counters.reconnects)
+		} else {
+			atomic.StoreInt64(&channel.counters.firstOnline, int64(time.Since(channel.created)))
+		}
+		channel.everOnline = true
+		channel.logger.Info("Online.")
+		channel.bootFailures = 0
+		if channel.bootSpan != nil {
+			channel.bootSpan.End(nil)
+			channel.bootSpan = nil
+		}
+		// credit the nodes of the round that brought us online
+		if !channel.bootStarted.IsZero() {
+			latency := time.Since(channel.bootStarted)
+			for _, node := range channel.bootstrapped {
+				channel.side.nodeSucceeded(node.PublicKey, latency)
+			}
+			channel.bootStarted = time.Time{}
+		}
+		channel.emit(Event{Kind: EvSelfOnline, Type: kind})
+		// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+		nodes := channel.bootstrapped
+		channel.dispatch("", func() { channel.handler().OnNetworkStatus(true, nodes) })
+	} else {
+		channel.logger.Info("Offline.")
+		channel.emit(Event{Kind: EvSelfOffline})
+		channel.dispatch("", func() { channel.handler().OnNetworkStatus(false, nil) })
+	}
+}
+
+/*
+nextNodes returns the next random subset of nodes to bootstrap to. The nodes are
+shuffled once, ranked by their health, and then used in turn so that every node
+is tried before any is tried again.
+*/
+func (channel *Channel) nextNodes() []Node {
+	channel.nodeMut.Lock()
+	defer channel.nodeMut.Unlock()
+	if len(channel.rotation) == 0 {
+		channel.rotation = make([]Node, len(channel.nodes))
+		copy(channel.rotation, channel.nodes)
+		rand.Shuffle(len(channel.rotation), func(i, j int) {
+			channel.rotation[i], channel.rotation[j] = channel.rotation[j], channel.rotation[i]
+		})
+		// historically good nodes first, consistently failing ones last
+		channel.side.rankNodes(channel.rotation)
+	}
+	count := bootstrapPerRound
+	if count > len(channel.rotation) {
+		count = len(channel.rotation)
+	}
+	subset := channel.rotation[:count]
+	channel.rotation = channel.rotation[count:]
+	return subset
+}
+
+/*
+requestBootstrap handles a Bootstrap call: unless the caller supplied their own
+nodes, the nodes are re-fetched first and the round runs once they arrive.
+Returns whether the round ran right away.
+*/
+func (channel *Channel) requestBootstrap(done chan error) bool {
+	if channel.isPaused() {
+		done <- ErrPaused
+		return false
+	}
+	if len(channel.options.BootstrapNodes) == 0 && !channel.custom {
+		channel.bootWaiters = append(channel.bootWaiters, done)
+		channel.refetchNodes()
+		return false
+	}
+	done <- channel.forceBootstrap()
+	return true
+}
+
+/*
+nodesFetched uses the nodes fetched in the background. Runs the bootstrap
+rounds Bootstrap calls are waiting for, or bootstraps right away if we are
+offline and the last round had no nodes to use. Returns whether a round ran.
+*/
+func (channel *Channel) nodesFetched(nodes []Node) bool {
+	channel.fetching = false
+	channel.useNodes(nodes)
+	if len(channel.bootWaiters) > 0 {
+		err := channel.forceBootstrap()
+		for _, done := range channel.bootWaiters {
+			done <- err
+		}
+		channel.bootWaiters = nil
+		return true
+	}
+	online, _ := channel.IsOnline()
+	if !online && !channel.isPaused() && time.Now().After(channel.graceUntil) && len(channel.bootstrapped) == 0 {
+		channel.bootstrap()
+		return true
+	}
+	return false
+}
+
+/*
+forceBootstrap runs an immediate bootstrap round with the known nodes.
+*/
+func (channel *Channel) forceBootstrap() error {
+	if channel.isPaused() {
+		return ErrPaused
+	}
+	channel.bootstrap()
+	// the caller expects the network to be back, so stop backing off
+	channel.bootFailures = 0
+	if len(channel.bootstrapped) == 0 {
+		return ErrBootstrap
+	}
+	return nil
+}
+
+/*
+bootstrap to the next random subset of the known nodes.
+*/
+func (channel *Channel) bootstrap() {
+	// the last round didn't bring us online, so its nodes failed
+	if channel.bootSpan != nil {
+		channel.bootSpan.End(ErrBootstrap)
+		channel.bootSpan = nil
+	}
+	if !channel.bootStarted.IsZero() {
+		for _, node := range channel.bootstrapped {
+			channel.side.nodeFailed(node.PublicKey)
+		}
+		channel.bootFailures++
+		if channel.bootFailures == unavailableAfter {
+			channel.logger.Warn("Network unavailable, backing off bootstrapping.")
+			channel.emit(Event{Kind: EvNetworkUnavailable})
+		}
+	}
+	nodes := channel.nextNodes()
+	channel.logger.Debug("Bootstrapping to Tox network with", len(nodes), "nodes.")
+	channel.bootstrapped = nil
+	// only rounds started offline are scored, a forced round while online proves nothing
+	channel.bootStarted = time.Time{}
+	if !channel.online {
+		channel.bootStarted = time.Now()
+	}
+	for _, node := range nodes {
+		publicKey, err := hex.DecodeString(node.PublicKey)
+		if err != nil {
+			channel.logger.Warn("Invalid public key for a node:", err)
+			continue
+		}
+		address := node.Address
+		if channel.options.AddressFamily == AfIPv6 {
+			address = node.AddressIPv6
+		}
+		if address == "" {
+			// node doesn't support the address family we use
+			continue
+		}
+		// without UDP only the TCP relay of a node is of use
+		if channel.options.DisableUDP {
+			inc(&channel.counters.bootAttempts)
+			if channel.addRelays(address, node.TCPPorts, publicKey) {
+				inc(&channel.counters.bootSuccesses)
+				channel.bootstrapped = append(channel.bootstrapped, node)
+			} else {
+				channel.side.nodeFailed(node.PublicKey)
+			}
+			continue
+		}
+		inc(&channel.counters.bootAttempts)
+		err = channel.tox.Bootstrap(address, node.Port, publicKey)
+		if err != nil {
+			channel.logger.Debug("Bootstrap error for a node:", err)
+			channel.side.nodeFailed(node.PublicKey)
+		} else {
+			inc(&channel.counters.bootSuccesses)
+			channel.bootstrapped = append(channel.bootstrapped, node)
+		}
+		// also use the node as TCP relay so that peers without UDP can be reached
+		if !channel.options.DisableTCPRelays {
+			channel.addRelays(address, node.TCPPorts, publicKey)
+		}
+	}
+	// like the scoring the span ends once the round brought us online
+	if channel.bootStarted.IsZero() {
+		return
+	}
+	channel.bootSpan = channel.startSpan("bootstrap", "nodes", strconv.Itoa(len(nodes)), "accepted", strconv.Itoa(len(channel.bootstrapped)))
+}
+
+/*
+addRelays adds the TCP relay of a node on all of the given ports. Returns
+whether any port was added.
+*/
+func (channel *Channel) addRelays(address string, ports []uint16, publicKey []byte) bool {
+	added := false
+	for _, port := range ports {
+		err := channel.tox.AddTcpRelay(address, port, publicKey)
+		if err != nil {
+			channel.logger.Debug("Adding TCP relay failed for a node:", err)
+			continue
+		}
+		added = true
+	}
+	return added
+}
@@ -0,0 +1,34 @@
+package channel
+
+import "testing"
+
+/*
+TestRequireMinNodes checks that only given or fetched nodes count towards
+MinNodes, and that a given backend never fetches any.
+*/
+func TestRequireMinNodes(t *testing.T) {
+	given := []Node{
+		{Address: "127.0.0.1", Port: 33445, PublicKey: "00"},
+		{Address: "127.0.0.2", Port: 33445, PublicKey: "01"}}
+	tests := []struct {
+		name     string
+		nodes    []Node
+		minNodes int
+		custom   bool
+		want     error
+	}{
+		{"enough given", given, 2, false, nil},
+		{"too few given", given, 3, false, ErrTooFewNodes},
+		{"given backend", nil, 1000, true, nil},
+	}
+	for _, test := range tests {
+		options := DefaultOptions()
+		options.BootstrapNodes = test.nodes
+		options.MinNodes = test.minNodes
+		options.RequireMinNodes = true
+		_, _, err := buildChannel(nil, options, test.custom)
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
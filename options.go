@@ -0,0 +1,327 @@
+package channel
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/codedust/go-tox"
+)
+
+/*
+Options allow tuning the behaviour of a channel. Use DefaultOptions to get sane
+values and modify only what is required.
+*/
+type Options struct {
+	/*IterateInterval is the interval at which Tox is iterated if it doesn't
+	suggest one, and at which the channel polls while waiting.*/
+	IterateInterval time.Duration
+	/*MinIterateInterval and MaxIterateInterval bound the interval Tox suggests
+	for iterating. The minimum is used while transfers run or messages wait to
+	be sent.*/
+	MinIterateInterval time.Duration
+	MaxIterateInterval time.Duration
+	/*BootstrapInterval is the base interval at which the channel checks whether
+	it must bootstrap once it has been online.*/
+	BootstrapInterval time.Duration
+	/*FastBootstrapInterval is the base interval at which bootstrapping is
+	retried until the channel is online for the first time.*/
+	FastBootstrapInterval time.Duration
+	/*SendInterval is the base interval at which new file transfers are started.*/
+	SendInterval time.Duration
+	/*SendTimeout is how long a file transfer may take to be accepted by the
+	other side before it is timed out. Raise it for slow relayed connections.*/
+	SendTimeout time.Duration
+	/*KeepaliveInterval is the interval at which all online friends are pinged
+	in the background. Zero disables keepalive pings.*/
+	KeepaliveInterval time.Duration
+	/*QueueOffline makes SendFile accept transfers to offline friends. These are
+	parked and started automatically once the friend comes online.*/
+	QueueOffline bool
+	/*OfflineTTL is how long a parked transfer waits for its friend to come
+	online before it is timed out.*/
+	OfflineTTL time.Duration
+	/*IncomingTTL is how long a file offer left pending by OnAllowFile waits
+	for AcceptIncoming or RejectIncoming before it is rejected automatically.*/
+	IncomingTTL time.Duration
+	/*MapFiles maps files that are sent into memory where supported, so that
+	chunks are copied instead of read, which helps large files on fast peers.
+	Files must not be truncated while they are sent, the transfer fails if they
+	are.*/
+	MapFiles bool
+	/*WriteBuffer is how many bytes of received chunks are collected before
+	they are written in one go. Zero uses 64 KiB, negative writes every chunk
+	directly.*/
+	WriteBuffer int
+	/*SyncPolicy decides when received files are synced to disk. Syncing less
+	is faster when receiving many small files but may lose data on a crash.
+	It can be overridden per file with AcceptIncomingWithSync.*/
+	SyncPolicy SyncPolicy
+	/*SyncEvery is how many bytes are written between syncs with SpPeriodic.*/
+	SyncEvery uint64
+	/*ReadAhead is how many chunks of a sent file are read ahead of the
+	requests in the background, to hide the latency of slow disks and network
+	filesystems. Zero disables reading ahead; it is not used for mapped files.*/
+	ReadAhead int
+	/*TrustedAddresses are addresses whose friend requests are accepted
+	automatically without calling OnFriendRequest, for peers paired out of
+	band.*/
+	TrustedAddresses []string
+	/*MaxFriends limits the number of friends. Tox itself has no practical
+	limit, but each friend costs bandwidth and memory. Zero means unlimited.*/
+	MaxFriends int
+	/*ResendRequests makes RequestConnection re-send the friend request until the
+	friend comes online or CancelRequest is called, as requests are lost if the
+	friend is offline when they are sent.*/
+	ResendRequests bool
+	/*ResendInterval is the initial interval between re-sends, doubled after
+	every re-send.*/
+	ResendInterval time.Duration
+	/*BootstrapNodes replaces the node list fetched via tox-dynboot, for example
+	for deployments behind firewalls or with private bootstrap nodes.*/
+	BootstrapNodes []Node
+	/*NodeCachePath is a file where successfully fetched bootstrap nodes are
+	cached. If fetching fails the cached nodes are used instead. Empty disables
+	the cache.*/
+	NodeCachePath string
+	/*UseSavedNodes makes a channel created from ToxData rely on the DHT nodes
+	stored in it instead of fetching bootstrap nodes. Nodes are only fetched and
+	bootstrapped to if the channel isn't online after SavedNodesGrace.*/
+	UseSavedNodes bool
+	/*SavedNodesGrace is how long UseSavedNodes waits for the channel to come
+	online.*/
+	SavedNodesGrace time.Duration
+	/*NodeFetchTimeout is how long fetching the alive nodes may take.*/
+	NodeFetchTimeout time.Duration
+	/*MinNodes is the number of bootstrap nodes below which a warning is
+	logged.*/
+	MinNodes int
+	/*RequireMinNodes makes Create fetch the nodes itself and fail if fewer than
+	MinNodes are given or fetched, instead of only warning. Cached and built-in
+	nodes don't count.*/
+	RequireMinNodes bool
+	/*NodeRefreshInterval is the interval at which the fetched node list is
+	refreshed so that long running channels don't keep bootstrapping to dead
+	nodes. Zero disables refreshing. Custom BootstrapNodes are never refreshed.*/
+	NodeRefreshInterval time.Duration
+	/*DisableTCPRelays stops the channel from adding bootstrap nodes that offer
+	TCP as relays. Relays allow reaching peers that can't use UDP, but route
+	traffic through third parties.*/
+	DisableTCPRelays bool
+	/*ProxyType selects the proxy to connect through. Note that Tox can only use
+	TCP through a proxy, so UDP should be disabled too.*/
+	ProxyType ProxyType
+	/*ProxyHost is the host name or IP address of the proxy.*/
+	ProxyHost string
+	/*ProxyPort is the port of the proxy.*/
+	ProxyPort uint16
+	/*StartPort and EndPort limit the range of UDP ports Tox may listen on. Zero
+	for both lets Tox choose.*/
+	StartPort uint16
+	EndPort   uint16
+	/*TCPPort is the port on which Tox offers a TCP relay to others. Zero
+	disables the TCP server.*/
+	TCPPort uint16
+	/*AddressFamily restricts the IP versions used. IPv6 is disabled in Tox for
+	AfIPv4, and bootstrapping only uses IPv6 addresses for AfIPv6.*/
+	AddressFamily AddressFamily
+	/*DisableUDP makes Tox use only TCP, for networks that drop UDP. All
+	connections then go through the TCP relays of the bootstrap nodes, so
+	DisableTCPRelays is ignored and nodes without a TCP relay are skipped.*/
+	DisableUDP bool
+	/*Passphrase encrypts the ToxData returned by ToxData and decrypts
+	encrypted ToxData given to Create, protecting the private key at rest. The
+	toxencryptsave format is used. Empty leaves the ToxData unencrypted.*/
+	Passphrase string
+	/*SavePath is a file to which the ToxData is persisted automatically after
+	the friend list changed, every SaveInterval, and on Close. Empty disables
+	saving unless SaveFunc is set.*/
+	SavePath string
+	/*SaveFunc, if set, is called with the ToxData instead of writing it to
+	SavePath.*/
+	SaveFunc func(toxdata []byte) error
+	/*SaveInterval is the interval at which the ToxData is persisted if saving
+	is enabled. Zero only saves on changes and on Close.*/
+	SaveInterval time.Duration
+	/*CallbackWorkers is the number of go routines that run the callbacks.
+	Callbacks for the same address always run on the same worker and thus in
+	order.*/
+	CallbackWorkers int
+	/*Logger receives all log output of at least LogLevel. Nil logs to the
+	standard log package.*/
+	Logger Logger
+	/*LogLevel is the initial level of log output, see SetLogLevel.*/
+	LogLevel LogLevel
+	/*AuditLog receives every event of the channel as one JSON object per
+	line, as a trail for finding out what happened. Nil disables it.*/
+	AuditLog io.Writer
+	/*Tracer receives spans around bootstrap rounds, transfers, and message
+	round trips. Nil disables tracing.*/
+	Tracer Tracer
+	/*Jitter is the maximal fraction (0 to 1) by which the intervals are randomly
+	varied per instance. This avoids many channels in one process waking up at
+	the same time.*/
+	Jitter float64
+}
+
+/*
+DefaultOptions returns the default options used by Create.
+*/
+func DefaultOptions() *Options {
+	return &Options{
+		IterateInterval:       50 * time.Millisecond,
+		MinIterateInterval:    5 * time.Millisecond,
+		MaxIterateInterval:    250 * time.Millisecond,
+		BootstrapInterval:     10 * time.Second,
+		FastBootstrapInterval: 5 * time.Second,
+		SendInterval:          1 * time.Second,
+		SendTimeout:           10 * time.Second,
+		OfflineTTL:            24 * time.Hour,
+		IncomingTTL:           10 * time.Minute,
+		WriteBuffer:           writeBufferSize,
+		SyncEvery:             16 << 20,
+		ResendInterval:        1 * time.Minute,
+		NodeRefreshInterval:   6 * time.Hour,
+		SavedNodesGrace:       30 * time.Second,
+		NodeFetchTimeout:      1 * time.Second,
+		SaveInterval:          5 * time.Minute,
+		CallbackWorkers:       4,
+		MinNodes:              5,
+		Jitter:                0.1}
+}
+
+/*
+torPort is the default SOCKS5 port of a local Tor daemon.
+*/
+const torPort = 9050
+
+/*
+TorOptions returns the default options changed to route all traffic through a
+local Tor daemon: SOCKS5 proxy on 127.0.0.1:9050 and no UDP. Peers are then
+only reached via the TCP relays of the bootstrap nodes. Note that go-tox can't
+turn off local discovery, so Tox still broadcasts on the local network outside
+of Tor.
+*/
+func TorOptions() *Options {
+	options := DefaultOptions()
+	options.ProxyType = PxSOCKS5
+	options.ProxyHost = "127.0.0.1"
+	options.ProxyPort = torPort
+	options.DisableUDP = true
+	return options
+}
+
+/*
+toxOptions builds the gotox options for the given savedata, which may be nil
+for a new identity. go-tox doesn't expose local discovery, so Tox always looks
+for peers on the local network as well.
+*/
+func (o Options) toxOptions(toxdata []byte) *gotox.Options {
+	options := &gotox.Options{
+		IPv6Enabled:  o.AddressFamily != AfIPv4,
+		UDPEnabled:   !o.DisableUDP,
+		ProxyType:    gotox.TOX_PROXY_TYPE_NONE,
+		StartPort:    o.StartPort,
+		EndPort:      o.EndPort,
+		TcpPort:      o.TCPPort,
+		SaveDataType: gotox.TOX_SAVEDATA_TYPE_TOX_SAVE,
+		SaveData:     toxdata}
+	if toxdata == nil {
+		options.SaveDataType = gotox.TOX_SAVEDATA_TYPE_NONE
+	}
+	switch o.ProxyType {
+	case PxHTTP:
+		options.ProxyType = gotox.TOX_PROXY_TYPE_HTTP
+	case PxSOCKS5:
+		options.ProxyType = gotox.TOX_PROXY_TYPE_SOCKS5
+	}
+	if o.ProxyType != PxNone {
+		options.ProxyHost = o.ProxyHost
+		options.ProxyPort = o.ProxyPort
+	}
+	return options
+}
+
+/*
+sanitize replaces invalid values with their defaults.
+*/
+func (o Options) sanitize() Options {
+	def := DefaultOptions()
+	if o.IterateInterval <= 0 {
+		o.IterateInterval = def.IterateInterval
+	}
+	if o.MinIterateInterval <= 0 {
+		o.MinIterateInterval = def.MinIterateInterval
+	}
+	if o.MaxIterateInterval < o.MinIterateInterval {
+		o.MaxIterateInterval = def.MaxIterateInterval
+		if o.MaxIterateInterval < o.MinIterateInterval {
+			o.MaxIterateInterval = o.MinIterateInterval
+		}
+	}
+	if o.BootstrapInterval <= 0 {
+		o.BootstrapInterval = def.BootstrapInterval
+	}
+	if o.FastBootstrapInterval <= 0 {
+		o.FastBootstrapInterval = def.FastBootstrapInterval
+	}
+	if o.SendInterval <= 0 {
+		o.SendInterval = def.SendInterval
+	}
+	if o.SendTimeout <= 0 {
+		o.SendTimeout = def.SendTimeout
+	}
+	if o.ResendInterval <= 0 {
+		o.ResendInterval = def.ResendInterval
+	}
+	if o.ProxyType != PxNone && o.ProxyHost == "" {
+		o.ProxyHost = "127.0.0.1"
+	}
+	// a single start port is a range of one
+	if o.StartPort != 0 && o.EndPort == 0 {
+		o.EndPort = o.StartPort
+	}
+	if o.OfflineTTL <= 0 {
+		o.OfflineTTL = def.OfflineTTL
+	}
+	if o.IncomingTTL <= 0 {
+		o.IncomingTTL = def.IncomingTTL
+	}
+	if o.ReadAhead < 0 {
+		o.ReadAhead = 0
+	}
+	if o.WriteBuffer == 0 {
+		o.WriteBuffer = writeBufferSize
+	}
+	if o.SyncEvery == 0 {
+		o.SyncEvery = def.SyncEvery
+	}
+	if o.SavedNodesGrace <= 0 {
+		o.SavedNodesGrace = def.SavedNodesGrace
+	}
+	if o.CallbackWorkers <= 0 {
+		o.CallbackWorkers = def.CallbackWorkers
+	}
+	if o.NodeFetchTimeout <= 0 {
+		o.NodeFetchTimeout = def.NodeFetchTimeout
+	}
+	// without UDP the relays are the only way to connect
+	if o.DisableUDP {
+		o.DisableTCPRelays = false
+	}
+	return o
+}
+
+/*
+jitter randomly varies the given duration by up to the given fraction.
+*/
+func jitter(duration time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return duration
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	factor := 1 + fraction*(2*rand.Float64()-1)
+	return time.Duration(float64(duration) * factor)
+}
@@ -0,0 +1,74 @@
+package channel
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestJitter checks that jitter stays within the given fraction, which is capped
+at one.
+*/
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		fraction float64
+		min, max time.Duration
+	}{
+		{"none", 0, time.Second, time.Second},
+		{"negative", -1, time.Second, time.Second},
+		{"tenth", 0.1, 900 * time.Millisecond, 1100 * time.Millisecond},
+		{"capped", 5, 0, 2 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if got := jitter(time.Second, test.fraction); got < test.min || got > test.max {
+				t.Fatalf("%s: %v not within [%v, %v]", test.name, got, test.min, test.max)
+			}
+		}
+	}
+}
+
+/*
+TestSanitize checks that invalid options are replaced by defaults and that
+options depending on each other are made consistent.
+*/
+func TestSanitize(t *testing.T) {
+	def := DefaultOptions()
+	tests := []struct {
+		name  string
+		in    Options
+		check func(o Options) bool
+	}{
+		{"zero intervals", Options{}, func(o Options) bool {
+			return o.IterateInterval == def.IterateInterval && o.SendInterval == def.SendInterval &&
+				o.BootstrapInterval == def.BootstrapInterval && o.ResendInterval == def.ResendInterval
+		}},
+		{"max below min", Options{MinIterateInterval: time.Hour, MaxIterateInterval: time.Second}, func(o Options) bool {
+			return o.MaxIterateInterval >= o.MinIterateInterval
+		}},
+		{"proxy without host", Options{ProxyType: PxSOCKS5}, func(o Options) bool {
+			return o.ProxyHost == "127.0.0.1"
+		}},
+		{"single start port", Options{StartPort: 33445}, func(o Options) bool {
+			return o.EndPort == 33445
+		}},
+		{"negative read ahead", Options{ReadAhead: -1}, func(o Options) bool {
+			return o.ReadAhead == 0
+		}},
+		{"no workers", Options{CallbackWorkers: -1}, func(o Options) bool {
+			return o.CallbackWorkers == def.CallbackWorkers
+		}},
+		{"relays without UDP", Options{DisableUDP: true, DisableTCPRelays: true}, func(o Options) bool {
+			return !o.DisableTCPRelays
+		}},
+		{"valid kept", Options{IterateInterval: time.Second, CallbackWorkers: 7}, func(o Options) bool {
+			return o.IterateInterval == time.Second && o.CallbackWorkers == 7
+		}},
+	}
+	for _, test := range tests {
+		if !test.check(test.in.sanitize()) {
+			t.Errorf("%s: sanitized options are wrong", test.name)
+		}
+	}
+}
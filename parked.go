@@ -0,0 +1,121 @@
+package channel
+
+import "time"
+
+/*
+parkedTransfer is a file transfer to an offline address waiting for it to come
+online.
+*/
+type parkedTransfer struct {
+	trans   *transfer
+	expires time.Time
+}
+
+/*
+parking holds all parked transfers by address. Owned by the background thread.
+*/
+type parking struct {
+	transfers map[Address][]parkedTransfer
+}
+
+/*
+park the transfer for the given address. A transfer for the same path that is
+already parked is replaced and returned so that it can be closed.
+*/
+func (p *parking) park(address Address, trans *transfer, ttl time.Duration) *transfer {
+	if p.transfers == nil {
+		p.transfers = make(map[Address][]parkedTransfer)
+	}
+	entry := parkedTransfer{trans: trans, expires: time.Now().Add(ttl)}
+	list := p.transfers[address]
+	for index, parked := range list {
+		if parked.trans.path == trans.path {
+			list[index] = entry
+			return parked.trans
+		}
+	}
+	p.transfers[address] = append(list, entry)
+	return nil
+}
+
+/*
+take removes and returns all parked transfers of the given address that have
+not expired yet. Expired ones are left for expired to collect.
+*/
+func (p *parking) take(address Address) []*transfer {
+	var valid []*transfer
+	var remaining []parkedTransfer
+	for _, parked := range p.transfers[address] {
+		if time.Now().Before(parked.expires) {
+			valid = append(valid, parked.trans)
+		} else {
+			remaining = append(remaining, parked)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(p.transfers, address)
+	} else {
+		p.transfers[address] = remaining
+	}
+	return valid
+}
+
+/*
+remove and return all parked transfers of the given address.
+*/
+func (p *parking) remove(address Address) []*transfer {
+	var all []*transfer
+	for _, parked := range p.transfers[address] {
+		all = append(all, parked.trans)
+	}
+	delete(p.transfers, address)
+	return all
+}
+
+/*
+expired removes and returns all parked transfers whose time to live has run out.
+*/
+func (p *parking) expired() []*transfer {
+	var expired []*transfer
+	for address, list := range p.transfers {
+		var remaining []parkedTransfer
+		for _, parked := range list {
+			if time.Now().Before(parked.expires) {
+				remaining = append(remaining, parked)
+			} else {
+				expired = append(expired, parked.trans)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(p.transfers, address)
+		} else {
+			p.transfers[address] = remaining
+		}
+	}
+	return expired
+}
+
+/*
+clear removes and returns all parked transfers.
+*/
+func (p *parking) clear() []*transfer {
+	var all []*transfer
+	for _, list := range p.transfers {
+		for _, parked := range list {
+			all = append(all, parked.trans)
+		}
+	}
+	p.transfers = nil
+	return all
+}
+
+/*
+counts returns the number of parked transfers by address.
+*/
+func (p *parking) counts() map[Address]int {
+	counts := make(map[Address]int)
+	for address, list := range p.transfers {
+		counts[address] = len(list)
+	}
+	return counts
+}
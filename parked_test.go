@@ -0,0 +1,55 @@
+package channel
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestParking checks that parked transfers are replaced by path, handed out only
+while they are valid and collected once they expired.
+*/
+func TestParking(t *testing.T) {
+	var p parking
+	first := &transfer{path: "a"}
+	if replaced := p.park("peer", first, time.Hour); replaced != nil {
+		t.Fatalf("parking into an empty spot replaced %v", replaced)
+	}
+	second := &transfer{path: "a"}
+	if replaced := p.park("peer", second, time.Hour); replaced != first {
+		t.Fatalf("parking the same path replaced %v, want the first transfer", replaced)
+	}
+	stale := &transfer{path: "b"}
+	p.park("peer", stale, -time.Second)
+	p.park("other", &transfer{path: "c"}, -time.Second)
+	tests := []struct {
+		name string
+		got  func() []*transfer
+		want []*transfer
+	}{
+		{"take leaves expired", func() []*transfer { return p.take("peer") }, []*transfer{second}},
+		{"take again", func() []*transfer { return p.take("peer") }, nil},
+		{"remove expired", func() []*transfer { return p.remove("peer") }, []*transfer{stale}},
+		{"remove unknown", func() []*transfer { return p.remove("unknown") }, nil},
+	}
+	for _, test := range tests {
+		got := test.got()
+		if len(got) != len(test.want) {
+			t.Fatalf("%s: got %d transfers, want %d", test.name, len(got), len(test.want))
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: transfer %d is %v, want %v", test.name, i, got[i], test.want[i])
+			}
+		}
+	}
+	if counts := p.counts(); counts["other"] != 1 || len(counts) != 1 {
+		t.Errorf("counts %v, want only other", counts)
+	}
+	if expired := p.expired(); len(expired) != 1 || expired[0].path != "c" {
+		t.Errorf("expired %v, want the transfer of other", expired)
+	}
+	if all := p.clear(); len(all) != 0 {
+		t.Errorf("clear returned %d transfers after all were collected", len(all))
+	}
+}
@@ -0,0 +1,131 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+PeerStats describes the connection quality of a single peer since the channel
+was created.
+*/
+type PeerStats struct {
+	/*Connects is how often the peer came online.*/
+	Connects int
+	/*ConnectsPerHour is the reconnect frequency since the peer was first seen.*/
+	ConnectsPerHour float64
+	/*AverageSession is the average time the peer stayed online, including the
+	current session.*/
+	AverageSession time.Duration
+	/*TransfersSucceeded counts successful file transfers with the peer.*/
+	TransfersSucceeded int
+	/*TransfersFailed counts failed, canceled, and timed out file transfers.*/
+	TransfersFailed int
+	/*FailureRate is the fraction of transfers that did not succeed.*/
+	FailureRate float64
+}
+
+/*
+peerRecord are the raw values behind PeerStats.
+*/
+type peerRecord struct {
+	firstSeen     time.Time
+	connects      int
+	sessionStart  time.Time // zero if offline
+	sessionsTotal time.Duration
+	succeeded     int
+	failed        int
+}
+
+/*
+quality tracks the connection quality of all peers.
+*/
+type quality struct {
+	mutex   sync.Mutex
+	records map[Address]*peerRecord
+}
+
+/*
+record returns the record of the given address, creating it. Must be called
+with the mutex held.
+*/
+func (q *quality) record(address Address) *peerRecord {
+	if q.records == nil {
+		q.records = make(map[Address]*peerRecord)
+	}
+	record, exists := q.records[address]
+	if !exists {
+		record = &peerRecord{firstSeen: time.Now()}
+		q.records[address] = record
+	}
+	return record
+}
+
+/*
+connected marks the start of a session.
+*/
+func (q *quality) connected(address Address) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	record := q.record(address)
+	record.connects++
+	record.sessionStart = time.Now()
+}
+
+/*
+disconnected marks the end of a session.
+*/
+func (q *quality) disconnected(address Address) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	record := q.record(address)
+	if record.sessionStart.IsZero() {
+		return
+	}
+	record.sessionsTotal += time.Since(record.sessionStart)
+	record.sessionStart = time.Time{}
+}
+
+/*
+transferDone records the outcome of a transfer.
+*/
+func (q *quality) transferDone(address Address, state State) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	record := q.record(address)
+	if state == StSuccess {
+		record.succeeded++
+	} else {
+		record.failed++
+	}
+}
+
+/*
+stats of the given address.
+*/
+func (q *quality) stats(address Address) (PeerStats, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	record, exists := q.records[address]
+	if !exists {
+		return PeerStats{}, false
+	}
+	stats := PeerStats{
+		Connects:           record.connects,
+		TransfersSucceeded: record.succeeded,
+		TransfersFailed:    record.failed}
+	if hours := time.Since(record.firstSeen).Hours(); hours > 0 {
+		stats.ConnectsPerHour = float64(record.connects) / hours
+	}
+	total := record.sessionsTotal
+	if !record.sessionStart.IsZero() {
+		total += time.Since(record.sessionStart)
+	}
+	if record.connects > 0 {
+		stats.AverageSession = total / time.Duration(record.connects)
+	}
+	if transfers := record.succeeded + record.failed; transfers > 0 {
+		stats.FailureRate = float64(record.failed) / float64(transfers)
+	}
+	return stats, true
+}
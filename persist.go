@@ -0,0 +1,79 @@
+package channel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+/*
+savingEnabled returns whether the ToxData is persisted automatically.
+*/
+func (channel *Channel) savingEnabled() bool {
+	return channel.options.SavePath != "" || channel.options.SaveFunc != nil
+}
+
+/*
+markDirty schedules the ToxData to be persisted with the next send tick.
+*/
+func (channel *Channel) markDirty() {
+	atomic.StoreInt32(&channel.dirty, 1)
+}
+
+/*
+saveIfDirty persists the ToxData if it changed since the last save.
+*/
+func (channel *Channel) saveIfDirty() {
+	if atomic.CompareAndSwapInt32(&channel.dirty, 1, 0) {
+		channel.save()
+	}
+}
+
+/*
+save persists the ToxData via the SaveFunc or to the SavePath. Files are written
+to a temporary file first and then renamed so a crash never leaves a partial
+profile behind.
+*/
+func (channel *Channel) save() {
+	if !channel.savingEnabled() {
+		return
+	}
+	data, err := channel.ToxData()
+	if err != nil {
+		channel.logger.Error("Save: getting ToxData failed:", err)
+		return
+	}
+	if channel.options.SaveFunc != nil {
+		err = channel.options.SaveFunc(data)
+		if err != nil {
+			channel.logger.Error("Save: SaveFunc failed:", err)
+		}
+		return
+	}
+	path := channel.options.SavePath
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		channel.logger.Error("Save: creating temporary file failed:", err)
+		return
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		channel.logger.Error("Save: writing ToxData failed:", err)
+		return
+	}
+	channel.logger.Debug("Saved ToxData to", path)
+}
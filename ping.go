@@ -0,0 +1,127 @@
+package channel
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+/*
+Lossy packet ids used by the channel. Tox reserves 200 to 254 for custom lossy
+packets.
+*/
+const (
+	packetPing byte = 200
+	packetPong byte = 201
+)
+
+/*
+pingExpiry after which unanswered pings are forgotten.
+*/
+const pingExpiry = 30 * time.Second
+
+/*
+pendingPing is a ping waiting for its pong.
+*/
+type pendingPing struct {
+	address Address
+	sent    time.Time
+	done    chan time.Duration // may be nil for keepalive pings
+}
+
+/*
+pong is the last measured round trip time of an address.
+*/
+type pong struct {
+	rtt time.Duration
+	at  time.Time
+}
+
+/*
+pinger keeps track of sent pings and the received pongs.
+*/
+type pinger struct {
+	mutex   sync.Mutex
+	next    uint64
+	pending map[uint64]*pendingPing
+	latest  map[Address]pong
+}
+
+/*
+buildPinger creates an empty pinger.
+*/
+func buildPinger() *pinger {
+	return &pinger{
+		pending: make(map[uint64]*pendingPing),
+		latest:  make(map[Address]pong)}
+}
+
+/*
+register a new ping to the given address, returning the packet to send.
+*/
+func (p *pinger) register(address Address, done chan time.Duration) (uint64, []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.next++
+	nonce := p.next
+	p.pending[nonce] = &pendingPing{address: address, sent: time.Now(), done: done}
+	packet := make([]byte, 9)
+	packet[0] = packetPing
+	binary.BigEndian.PutUint64(packet[1:], nonce)
+	return nonce, packet
+}
+
+/*
+forget the ping with the given nonce.
+*/
+func (p *pinger) forget(nonce uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.pending, nonce)
+}
+
+/*
+expire removes all pings that have not been answered in time.
+*/
+func (p *pinger) expire() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for nonce, ping := range p.pending {
+		if time.Since(ping.sent) > pingExpiry {
+			delete(p.pending, nonce)
+		}
+	}
+}
+
+/*
+receive a pong payload from the given address.
+*/
+func (p *pinger) receive(address Address, payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	nonce := binary.BigEndian.Uint64(payload)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ping, exists := p.pending[nonce]
+	// only accept pongs from the address that was pinged
+	if !exists || ping.address != address {
+		return
+	}
+	delete(p.pending, nonce)
+	rtt := time.Since(ping.sent)
+	p.latest[address] = pong{rtt: rtt, at: time.Now()}
+	if ping.done != nil {
+		ping.done <- rtt
+	}
+}
+
+/*
+last returns the last pong of the given address.
+*/
+func (p *pinger) last(address Address) (pong, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	last, exists := p.latest[address]
+	return last, exists
+}
@@ -2,14 +2,14 @@ package channel
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/codedust/go-tox"
-	"github.com/xamino/tox-dynboot"
 )
 
 /*
@@ -18,55 +18,141 @@ until Close() is called.
 */
 func (channel *Channel) run() {
 	// log when stopping background process (even if returning error)
-	defer func() { log.Println(tag, "Background process stopped.") }()
-	// read ToxNodes
-	toxNodes, err := toxdynboot.FetchAlive(1 * time.Second)
-	if err != nil {
-		log.Println(tag, "Fetching ToxNodes for Tox failed!", err)
-	}
-	// warn if less than 5 ToxNodes (even 0)
-	if len(toxNodes) < 5 {
-		log.Println(tag, "WARNING: Too few ToxNodes!", len(toxNodes), " ToxNodes found.")
+	defer func() { channel.logger.Info("Background process stopped.") }()
+	// read ToxNodes unless we try the saved ones first
+	if channel.graceUntil.IsZero() {
+		channel.fetchNodesLater()
 	}
-	// TODO: how to use tox.GetIterationIntervall to update ticker without performance loss? For now: just tick every 50ms
-	iterateTicker := time.Tick(50 * time.Millisecond)
-	// we check if we have to bootstrap every 10 seconds (this will allow clean reconnect if we ever loose internet)
-	bootTicker := time.Tick(10 * time.Second) // FIXME: if first start we can bootstrap every 5 seconds until connected
+	// all intervals are jittered per instance so that multiple channels don't tick in lockstep
+	jit := channel.options.Jitter
+	// iterate at the interval Tox asks for, rescheduled after every iteration
+	iterateTimer := time.NewTimer(jitter(channel.options.IterateInterval, jit))
+	defer iterateTimer.Stop()
+	// we check if we have to bootstrap regularly (this will allow clean reconnect if we ever loose internet)
+	bootTimer := time.NewTimer(channel.bootstrapInterval())
+	defer bootTimer.Stop()
 	// ticker for starting new sending transfers
-	sendTicker := time.Tick(1 * time.Second)
+	sendTicker := time.Tick(jitter(channel.options.SendInterval, jit))
+	// ticker for keepalive pings, nil (never fires) if disabled
+	keepaliveTicker := time.Tick(jitter(channel.options.KeepaliveInterval, jit))
+	// ticker for refreshing the fetched node list, nil if disabled or custom nodes are used
+	var refreshTicker <-chan time.Time
+	if len(channel.options.BootstrapNodes) == 0 {
+		refreshTicker = time.Tick(jitter(channel.options.NodeRefreshInterval, jit))
+	}
+	// ticker for persisting the ToxData, nil if disabled
+	var saveTicker <-chan time.Time
+	if channel.savingEnabled() {
+		saveTicker = time.Tick(jitter(channel.options.SaveInterval, jit))
+	}
 	// endless loop until close is called for tox.Iterate
 	for {
 		// select whether we have to close, iterate, or check online status
 		select {
 		case <-channel.stop:
 			// close wg and return (we're done)
+			close(channel.stopped)
 			channel.wg.Done()
 			return
-		case <-iterateTicker:
-			// try to iterate
-			err := channel.tox.Iterate()
-			if err != nil {
-				log.Println(tag, "Run:", err)
-			}
-		case <-bootTicker:
-			// don't bootstrap if channel is online
+		case <-iterateTimer.C:
+			channel.iterate()
+			iterateTimer.Reset(channel.iterationInterval())
+		case <-bootTimer.C:
+			// don't bootstrap if channel is online or paused
 			online, _ := channel.IsOnline()
-			if online {
-				break
+			if !online && !channel.isPaused() && time.Now().After(channel.graceUntil) {
+				// nodes are fetched late if the saved ones were tried first
+				channel.fetchNodesLater()
+				channel.bootstrap()
+			}
+			// schedule the next check, adapting to whether we were ever online and to failures
+			bootTimer.Reset(channel.bootstrapInterval())
+		case resume := <-channel.suspends:
+			channel.logger.Info("Suspended.")
+			// park until resumed or closed
+			suspended := true
+			for suspended {
+				select {
+				case <-resume:
+					channel.logger.Info("Resumed.")
+					suspended = false
+				case reply := <-channel.dumps:
+					// a hanging channel may well be a suspended one
+					reply <- channel.debugState()
+				case command := <-channel.commands:
+					// public methods must not block while suspended
+					command()
+				case <-channel.stop:
+					close(channel.stopped)
+					channel.wg.Done()
+					return
+				}
+			}
+		case request := <-channel.restarts:
+			request.done <- channel.restartTox(request.toxdata, request.side)
+		case done := <-channel.idleChecks:
+			done <- channel.idle()
+		case reply := <-channel.dumps:
+			reply <- channel.debugState()
+		case command := <-channel.commands:
+			command()
+		case done := <-channel.rebootstrap:
+			// the forced round replaces the next scheduled one
+			if channel.requestBootstrap(done) {
+				if !bootTimer.Stop() {
+					<-bootTimer.C
+				}
+				bootTimer.Reset(channel.bootstrapInterval())
 			}
-			log.Println(tag, "Bootstrapping to Tox network with", len(toxNodes), "nodes.")
-			// try to bootstrap to all nodes. Better: random set of 4 nodes, but meh.
-			for _, node := range toxNodes {
-				err := channel.tox.Bootstrap(node.IPv4, node.Port, node.PublicKey)
-				if err != nil {
-					log.Println(tag, "Bootstrap error for a node:", err)
+		case nodes := <-channel.fetched:
+			// a round run for the new nodes replaces the next scheduled one
+			if channel.nodesFetched(nodes) {
+				if !bootTimer.Stop() {
+					<-bootTimer.C
 				}
-			} // bootstrap for
+				bootTimer.Reset(channel.bootstrapInterval())
+			}
+		case <-keepaliveTicker:
+			if !channel.isPaused() {
+				channel.keepalive()
+			}
+		case <-saveTicker:
+			channel.markDirty()
+			channel.saveIfDirty()
+		case <-refreshTicker:
+			if !channel.isPaused() {
+				channel.refetchNodes()
+			}
 		case <-sendTicker:
+			// persist friend list changes
+			channel.saveIfDirty()
+			if channel.isPaused() {
+				break
+			}
+			// re-send friend requests that are due
+			channel.resendRequests()
+			// time out parked transfers whose friend didn't come online in time
+			for _, tran := range channel.parked.expired() {
+				tran.Close(StTimeout)
+			}
+			// reject offers nobody decided on in time
+			for _, offer := range channel.incoming.expired() {
+				channel.logger.Debug("Rejecting expired file offer", offer.Name, "from", offer.Address)
+				channel.tox.FileControl(offer.friend, offer.file, gotox.TOX_FILE_CONTROL_CANCEL)
+			}
 			// for every sending candidate
-			for address, ready := range channel.sending {
+			for address, ready := range channel.transfers.allQueues() {
 				// check if transfer already active
-				sendTran, exists := channel.sendActive[address]
+				sendTran, exists := channel.transfers.activeOf(address)
+				// cancel the active transfer if its context expired
+				if exists {
+					if tran, ok := channel.transfers.get(sendTran.fileNumber); ok && tran.canceled() {
+						channel.tox.FileControl(tran.friend, sendTran.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+						channel.closeTransfer(sendTran.fileNumber, StCanceled)
+						channel.transfers.removeActive(address)
+						continue
+					}
+				}
 				// if not:
 				if !exists {
 					// check if we can start new transfer
@@ -83,65 +169,414 @@ func (channel *Channel) run() {
 					// cancel transfer
 					channel.closeTransfer(sendTran.fileNumber, StTimeout)
 					// remove sendtransfer
-					delete(channel.sendActive, address)
+					channel.transfers.removeActive(address)
 				}
 			}
 		} // select
 	} // endless for
 }
 
+/*
+iterate sends what is waiting and iterates Tox once.
+*/
+func (channel *Channel) iterate() {
+	atomic.StoreInt64(&channel.lastTick, time.Now().UnixNano())
+	// while paused only notice that we are offline now
+	if channel.isPaused() {
+		channel.checkOnline()
+		return
+	}
+	// high priority messages first, then chunks held back by the rate limit, then bulk
+	channel.serveOutbox(PrHigh)
+	channel.serveDeferred()
+	channel.serveOutbox(PrBulk)
+	// try to iterate
+	err := channel.tox.Iterate()
+	if err != nil {
+		channel.logger.Error("Run:", err)
+	}
+	channel.checkOnline()
+}
+
+/*
+iterationInterval returns the time until the next iteration: what Tox asks for,
+or the minimum while transfers run or messages or chunks are waiting, within
+the configured bounds.
+*/
+func (channel *Channel) iterationInterval() time.Duration {
+	interval := channel.options.IterateInterval
+	if ms, err := channel.tox.IterationInterval(); err == nil && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	if channel.transfers.count() > 0 || !channel.outbox.empty() || len(channel.deferred) > 0 {
+		interval = channel.options.MinIterateInterval
+	}
+	if interval < channel.options.MinIterateInterval {
+		interval = channel.options.MinIterateInterval
+	}
+	if interval > channel.options.MaxIterateInterval {
+		interval = channel.options.MaxIterateInterval
+	}
+	return interval
+}
+
+/*
+idle returns true if no transfers are running or queued and no messages are
+waiting to be sent. Parked transfers don't count as they wait for offline
+friends.
+*/
+func (channel *Channel) idle() bool {
+	return channel.transfers.idle() && len(channel.deferred) == 0 && channel.outbox.empty()
+}
+
+/*
+isClosing returns whether CloseGraceful was called.
+*/
+func (channel *Channel) isClosing() bool {
+	return atomic.LoadInt32(&channel.closing) == 1
+}
+
+/*
+isClosed returns whether Tox was killed by Close.
+*/
+func (channel *Channel) isClosed() bool {
+	return atomic.LoadInt32(&channel.closed) == 1
+}
+
+/*
+requestRestart hands the restart to the background thread and waits for the
+result.
+*/
+func (channel *Channel) requestRestart(request restart) error {
+	select {
+	case channel.restarts <- request:
+	case <-channel.stopped:
+		return ErrClosed
+	}
+	return <-request.done
+}
+
+/*
+isPaused returns whether networking was paused with GoOffline.
+*/
+func (channel *Channel) isPaused() bool {
+	return atomic.LoadInt32(&channel.paused) == 1
+}
+
+/*
+keepalive pings all online friends. The round trip times can be read with
+LastPong.
+*/
+func (channel *Channel) keepalive() {
+	channel.pings.expire()
+	addresses, err := channel.OnlineAddresses()
+	if err != nil {
+		channel.logger.Warn("Keepalive:", err)
+		return
+	}
+	for _, address := range addresses {
+		friend, err := channel.friendNumberOf(address)
+		if err != nil {
+			continue
+		}
+		_, packet := channel.pings.register(address, nil)
+		err = channel.tox.FriendSendLossyPacket(friend, packet)
+		if err != nil {
+			channel.logger.Debug("Keepalive: ping failed:", err)
+		}
+	}
+}
+
+/*
+resendRequests re-sends all due friend requests. Tox itself keeps re-sending the
+request of a pending friend, so the request is only added again if the friend
+no longer exists.
+*/
+func (channel *Channel) resendRequests() {
+	for address, request := range channel.resends.due() {
+		publicKey, err := hex.DecodeString(request.id)
+		if err != nil || len(publicKey) < publicKeySize {
+			channel.logger.Warn("Dropping friend request to malformed ID", request.id)
+			channel.resends.remove(address)
+			continue
+		}
+		if _, err := channel.tox.FriendByPublicKey(publicKey[:publicKeySize]); err == nil {
+			// still pending, Tox takes care of it
+			continue
+		}
+		num, err := channel.tox.FriendAdd(publicKey, request.message)
+		if err != nil {
+			channel.logger.Warn("Re-sending friend request failed:", err)
+			continue
+		}
+		// friend numbers are reused, so forget any stale connection status
+		delete(channel.connStatus, num)
+		channel.notifyFriendAdded(address)
+	}
+}
+
 /*
 closeTransfer is a helper function that handles the complete removal of an active
-transfer including callbacks etc.
+transfer including callbacks etc. Returns the state the transfer finished with,
+which is StFailed instead of StSuccess if the file couldn't be written out.
 */
-func (channel *Channel) closeTransfer(fileNumber uint32, reason State) {
-	tran, exists := channel.transfers[fileNumber]
+func (channel *Channel) closeTransfer(fileNumber uint32, reason State) State {
+	tran, exists := channel.transfers.remove(fileNumber)
 	if !exists {
-		log.Println(tag, "WARNING: failed to close transfer, doesn't exist!")
-		return
+		channel.logger.Warn("Failed to close transfer, doesn't exist!")
+		return reason
+	}
+	reason = tran.Close(reason)
+	switch reason {
+	case StSuccess:
+		inc(&channel.counters.transfersCompleted)
+		if seconds := time.Since(tran.began).Seconds(); seconds > 0 {
+			channel.timings.throughput.observe(float64(tran.size) / seconds)
+		}
+	case StFailed:
+		inc(&channel.counters.transfersFailed)
+	case StTimeout:
+		inc(&channel.counters.transfersTimedOut)
+	case StCanceled:
+		inc(&channel.counters.transfersCanceled)
+	}
+	if address, err := channel.addressOf(tran.friend); err == nil {
+		channel.quality.transferDone(address, reason)
+		channel.emit(Event{Kind: EvTransferDone, Address: address, Path: tran.path, State: reason})
 	}
-	tran.Close(reason)
-	delete(channel.transfers, fileNumber)
+	return reason
 }
 
 /*
 addressOf given friend number.
 */
-func (channel *Channel) addressOf(friendnumber uint32) (string, error) {
+func (channel *Channel) addressOf(friendnumber uint32) (Address, error) {
 	publicKey, err := channel.tox.FriendGetPublickey(friendnumber)
 	if err != nil {
-		return "", errLostAddress
+		return "", ErrLostAddress
 	}
-	return hex.EncodeToString(publicKey), nil
+	return addressOfKey(publicKey), nil
 }
 
 /*
 friendNumberOf the given address.
 */
-func (channel *Channel) friendNumberOf(address string) (uint32, error) {
-	publicKey, err := hex.DecodeString(address)
+func (channel *Channel) friendNumberOf(address Address) (uint32, error) {
+	publicKey, err := address.PublicKey()
 	if err != nil {
 		return 0, err
 	}
-	return channel.tox.FriendByPublicKey(publicKey)
+	num, err := channel.tox.FriendByPublicKey(publicKey)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", address, toxErr("FriendByPublicKey", err))
+	}
+	return num, nil
+}
+
+/*
+enqueue the transfer for sending to the given address.
+*/
+func (channel *Channel) enqueue(address Address, tran *transfer) error {
+	// write to queue if possible
+	select {
+	case channel.transfers.queue(address) <- tran:
+		return nil
+	default:
+		// if not return error so caller knows it failed
+		return ErrSendBufferFull
+	}
+}
+
+/*
+checkCapacity returns an error if no more friends may be added.
+*/
+func (channel *Channel) checkCapacity() error {
+	capacity, err := channel.FriendCapacity()
+	if err != nil {
+		return err
+	}
+	if capacity == 0 {
+		return ErrFriendLimit
+	}
+	return nil
 }
 
 /*
 triggerSend makes sure that we start transfering a file for the given address.
 Will handle working through the queue in FIFO order.
 */
-func (channel *Channel) triggerSend(address string, trans *transfer) {
+func (channel *Channel) triggerSend(address Address, trans *transfer) {
+	if trans.canceled() {
+		trans.Close(StCanceled)
+		return
+	}
 	// prepare send (file will be transmitted via filechunk)
 	fileNumber, err := channel.tox.FileSend(trans.friend, gotox.TOX_FILE_KIND_DATA, trans.size, nil, trans.name)
 	if err != nil {
 		// failed to send file
 		trans.Close(StFailed)
+		channel.quality.transferDone(address, StFailed)
+		channel.emit(Event{Kind: EvTransferDone, Address: address, Path: trans.path, State: StFailed})
 		return
 	}
 	// note that we are currently transfering something
-	channel.sendActive[address] = buildSendTransfer(fileNumber)
+	timeout := trans.timeout
+	if timeout == 0 {
+		timeout = channel.options.SendTimeout
+	}
+	channel.transfers.setActive(address, buildSendTransfer(fileNumber, timeout))
+	// start reading the file before the first chunk is requested
+	if channel.options.ReadAhead > 0 && trans.mapped == nil {
+		trans.ahead = buildReadAhead(trans.file, trans.size, channel.options.ReadAhead, channel.routines)
+	}
 	// create transfer object
-	channel.transfers[fileNumber] = trans
+	trans.span = channel.startSpan("transfer.send", "address", address.String(), "path", trans.path, "size", formatUint(trans.size))
+	channel.transfers.add(fileNumber, trans)
+	channel.emit(Event{Kind: EvTransferStarted, Address: address, Path: trans.path})
+}
+
+/*
+do runs the given command on the background thread and waits for it, so that it
+may use the transfers, queues and parked transfers, which only the background
+thread owns. Must not be called from the background thread.
+*/
+func (channel *Channel) do(command func()) error {
+	done := make(chan bool)
+	select {
+	case channel.commands <- func() {
+		command()
+		close(done)
+	}:
+	case <-channel.stopped:
+		return ErrClosed
+	}
+	<-done
+	return nil
+}
+
+/*
+dispatch the given callback to the workers, in order with all other callbacks
+for the same address. Callbacks dropped by a full worker are counted.
+*/
+func (channel *Channel) dispatch(address Address, call func()) {
+	if !channel.dispatcher.dispatch(address, call) {
+		inc(&channel.counters.droppedEvents)
+	}
+}
+
+/*
+handler returns the callbacks currently registered.
+*/
+func (channel *Channel) handler() Callbacks {
+	channel.callbackMut.RLock()
+	defer channel.callbackMut.RUnlock()
+	return channel.callbacks
+}
+
+/*
+updateFuncs registers a single callback function. The current Funcs are copied
+and replaced rather than changed so that events being delivered concurrently
+never see a half written Funcs. Callbacks that aren't Funcs are wrapped, so they
+still receive all events no function is registered for.
+*/
+func (channel *Channel) updateFuncs(update func(funcs *Funcs)) {
+	channel.callbackMut.Lock()
+	defer channel.callbackMut.Unlock()
+	var funcs *Funcs
+	if current, ok := channel.callbacks.(*Funcs); ok {
+		funcs = current.clone()
+	} else {
+		funcs = &Funcs{wrapped: channel.callbacks}
+	}
+	update(funcs)
+	channel.callbacks = funcs
+}
+
+/*
+notifyFriendAdded calls the callbacks for a new friend. Also notifies about the
+changed friend list.
+*/
+func (channel *Channel) notifyFriendAdded(address Address) {
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch(address, func() { channel.handler().OnFriendAdded(address) })
+	channel.emit(Event{Kind: EvFriendAdded, Address: address})
+	channel.notifyFriendListChanged()
+}
+
+/*
+notifyFriendListChanged calls the callback for a changed friend list.
+*/
+func (channel *Channel) notifyFriendListChanged() {
+	// don't lose new friends if we crash
+	channel.markDirty()
+	channel.dispatch("", func() { channel.handler().OnFriendListChanged() })
+}
+
+/*
+streamOf returns the stream for the given address, creating it if required.
+*/
+func (channel *Channel) streamOf(address Address, friend uint32) *stream {
+	channel.streamMut.Lock()
+	defer channel.streamMut.Unlock()
+	s, exists := channel.streams[address]
+	if !exists {
+		s = buildStream(channel, address, friend)
+		channel.streams[address] = s
+	}
+	return s
+}
+
+/*
+removeStream removes the given stream if it is still the registered one.
+*/
+func (channel *Channel) removeStream(s *stream) {
+	channel.streamMut.Lock()
+	defer channel.streamMut.Unlock()
+	if channel.streams[s.address] == s {
+		delete(channel.streams, s.address)
+	}
+}
+
+/*
+userStatusOf converts the gotox user status to ours.
+*/
+func userStatusOf(status gotox.ToxUserStatus) UserStatus {
+	switch status {
+	case gotox.TOX_USERSTATUS_AWAY:
+		return UsAway
+	case gotox.TOX_USERSTATUS_BUSY:
+		return UsBusy
+	default:
+		return UsNone
+	}
+}
+
+/*
+connectionTypeOf converts the gotox connection status to our connection type.
+*/
+func connectionTypeOf(status gotox.ToxConnection) ConnectionType {
+	switch status {
+	case gotox.TOX_CONNECTION_TCP:
+		return CtTCP
+	case gotox.TOX_CONNECTION_UDP:
+		return CtUDP
+	default:
+		return CtNone
+	}
+}
+
+/*
+hangUpStream closes the stream of the given address from the remote side, if
+one exists.
+*/
+func (channel *Channel) hangUpStream(address Address) {
+	channel.streamMut.Lock()
+	s, exists := channel.streams[address]
+	channel.streamMut.Unlock()
+	if exists {
+		s.hangUp()
+		channel.removeStream(s)
+	}
 }
 
 /*******************************************************************************
@@ -152,38 +587,79 @@ NOTE: ALL BELOW ARE TOX CALLBACKS
 onFriendRequest calls the appropriate callback, wrapping it sanely for our purposes.
 */
 func (channel *Channel) onFriendRequest(_ *gotox.Tox, publicKey []byte, message string) {
-	if channel.callbacks != nil {
-		// strip key of NOSPAM - this is the only instance where it is passed here
-		if len(publicKey) > 32 {
-			publicKey = publicKey[:32]
+	// strip key of NOSPAM - this is the only instance where it is passed here
+	if len(publicKey) > 32 {
+		if ValidateAddress(hex.EncodeToString(publicKey)) == nil {
+			channel.side.setFullID(addressOfKey(publicKey), hex.EncodeToString(publicKey))
 		}
-		// all real callbacks are run in separate go routines to keep ToxCore none blocking!
-		go channel.callbacks.OnFriendRequest(hex.EncodeToString(publicKey), message)
-	} else {
-		log.Println(tag, "No callback for OnNewConnection registered!")
+		publicKey = publicKey[:32]
 	}
+	address := addressOfKey(publicKey)
+	if channel.side.isBlocked(address) {
+		return
+	}
+	// trusted addresses are accepted without asking
+	if channel.trusted[address] {
+		err := channel.AcceptConnection(address)
+		if err != nil {
+			channel.logger.Error("Failed to auto accept trusted address:", err)
+		}
+		return
+	}
+	// buffer the request so that it can be decided on later
+	channel.requests.add(FriendRequest{Address: address, Message: message, Received: time.Now()})
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch(address, func() { channel.handler().OnFriendRequest(address, message) })
 }
 
 /*
 onFriendMessage calls the appropriate callback, wrapping it sanely for our purposes.
 */
 func (channel *Channel) onFriendMessage(_ *gotox.Tox, friendnumber uint32, messagetype gotox.ToxMessageType, message string) {
-	/*TODO make sensible*/
-	if messagetype == gotox.TOX_MESSAGE_TYPE_NORMAL {
-		if channel.callbacks != nil {
-			address, err := channel.addressOf(friendnumber)
-			if err != nil {
-				log.Println(tag, err)
-				address = illegalAddress
-			}
-			// all real callbacks are run in separate go routines to keep ToxCore none blocking!
-			go channel.callbacks.OnMessage(address, message)
-		} else {
-			log.Println(tag, "No callback for OnMessage registered!")
-		}
-	} else {
-		log.Println(tag, "Invalid message type, ignoring!")
+	var kind MessageType
+	switch messagetype {
+	case gotox.TOX_MESSAGE_TYPE_NORMAL:
+		kind = MsNormal
+	case gotox.TOX_MESSAGE_TYPE_ACTION:
+		kind = MsAction
+	default:
+		channel.logger.Warn("Invalid message type, ignoring!")
+		return
+	}
+	address, err := channel.addressOf(friendnumber)
+	if err != nil {
+		channel.logger.Warn("OnMessage:", err)
+		return
+	}
+	if channel.side.isBlocked(address) {
+		return
+	}
+	channel.seen.touch(address)
+	message, err = channel.unseal(address, message)
+	if err != nil {
+		channel.logger.Warn("Failed to decrypt message, ignoring!", err)
+		return
+	}
+	inc(&channel.counters.messagesReceived)
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch(address, func() { channel.handler().OnMessage(address, message, kind) })
+}
+
+/*
+onFriendReadReceipt is called when a friend has received a message. Wakes up any
+SendReliable waiting for it.
+*/
+func (channel *Channel) onFriendReadReceipt(_ *gotox.Tox, friendnumber uint32, messageid uint32) {
+	key := receipt{friend: friendnumber, message: messageid}
+	channel.receiptMut.Lock()
+	defer channel.receiptMut.Unlock()
+	done, exists := channel.receipts[key]
+	if !exists {
+		// message was not sent reliably or the waiter gave up
+		return
 	}
+	done <- true
+	delete(channel.receipts, key)
 }
 
 /*
@@ -192,44 +668,109 @@ offline, or the connection state changes. In all cases we terminate any ongoing
 transfers (will need to be restarted).
 */
 func (channel *Channel) onFriendConnectionStatusChanges(_ *gotox.Tox, friendnumber uint32, connectionstatus gotox.ToxConnection) {
-	log.Println(tag, "detected status change")
+	channel.logger.Debug("Detected status change.")
 	// get address of friend since we can't execute callbacks without out
 	address, err := channel.addressOf(friendnumber)
 	if err != nil {
-		log.Println(tag, "OnConnected: failed to retrieve address:", err)
+		channel.logger.Warn("OnConnected: failed to retrieve address:", err)
 		// but continue with default value
 	}
-	// cancel any running file transfers no matter what changed (if newly connected a disconnect happened before)
-	canceled := make(map[uint32]*transfer)
-	for filenumber, trans := range channel.transfers {
-		if trans.friend == friendnumber {
-			canceled[filenumber] = trans
-		}
+	channel.seen.touch(address)
+	previous := channel.connStatus[friendnumber]
+	channel.connStatus[friendnumber] = connectionstatus
+	// switching between UDP and TCP doesn't interrupt the connection, so transfers can continue
+	if previous != gotox.TOX_CONNECTION_NONE && connectionstatus != gotox.TOX_CONNECTION_NONE {
+		// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+		kind := connectionTypeOf(connectionstatus)
+		channel.dispatch(address, func() { channel.handler().OnConnectionTypeChanged(address, kind) })
+		return
 	}
-	for filenumber, tran := range canceled {
+	// cancel any running file transfers no matter what changed (if newly connected a disconnect happened before)
+	for filenumber, tran := range channel.transfers.ofFriend(friendnumber) {
 		channel.closeTransfer(filenumber, StFailed)
 		// also callback OnFileCanceled!
-		if channel.callbacks != nil {
-			go channel.callbacks.OnFileCanceled(address, tran.path)
-		} else {
-			log.Println(tag, "No callback for OnFileCanceled registered!")
-		}
+		path := tran.path
+		channel.dispatch(address, func() { channel.handler().OnFileCanceled(address, path) })
 	}
 	// remember to remove from sendActive IF it existed!
-	if _, exists := channel.sendActive[address]; exists {
-		delete(channel.sendActive, address)
-	}
-	// if going offline do nothing
+	channel.transfers.removeActive(address)
+	// offers die with the connection
+	channel.incoming.removeFriend(friendnumber)
+	// if going offline do nothing except hanging up any stream
 	if connectionstatus == gotox.TOX_CONNECTION_NONE {
+		channel.quality.disconnected(address)
+		channel.hangUpStream(address)
+		channel.emit(Event{Kind: EvFriendOffline, Address: address})
 		// TODO add callback: OnDisconnected
 		return
 	}
-	if channel.callbacks != nil {
-		// all real callbacks are run in separate go routines to keep ToxCore none blocking!
-		go channel.callbacks.OnConnected(address)
-	} else {
-		log.Println(tag, "No callback for OnConnected registered!")
+	channel.quality.connected(address)
+	channel.emit(Event{Kind: EvFriendOnline, Address: address, Type: connectionTypeOf(connectionstatus)})
+	// the friend request was obviously accepted
+	channel.resends.remove(address)
+	// start any transfers that were parked while the friend was offline
+	for _, tran := range channel.parked.take(address) {
+		if err := channel.enqueue(address, tran); err != nil {
+			channel.logger.Error("Failed to start parked transfer:", err)
+			tran.Close(StFailed)
+		}
 	}
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	kind := connectionTypeOf(connectionstatus)
+	channel.dispatch(address, func() { channel.handler().OnConnected(address, kind) })
+}
+
+/*
+onSelfConnectionStatusChanges is called when the connection of the channel to
+the Tox network changes.
+*/
+func (channel *Channel) onSelfConnectionStatusChanges(_ *gotox.Tox, connectionstatus gotox.ToxConnection) {
+	// while paused we are offline no matter what Tox thinks
+	if channel.isPaused() {
+		return
+	}
+	channel.selfConnectionChanged(connectionTypeOf(connectionstatus))
+}
+
+/*
+onFriendStatusChanges is called when a friend changes their user status.
+*/
+func (channel *Channel) onFriendStatusChanges(_ *gotox.Tox, friendnumber uint32, userstatus gotox.ToxUserStatus) {
+	address, err := channel.addressOf(friendnumber)
+	if err != nil {
+		channel.logger.Warn("OnStatusChange:", err)
+		return
+	}
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	status := userStatusOf(userstatus)
+	channel.dispatch(address, func() { channel.handler().OnStatusChange(address, status) })
+}
+
+/*
+onFriendNameChanges is called when a friend changes their name.
+*/
+func (channel *Channel) onFriendNameChanges(_ *gotox.Tox, friendnumber uint32, name string) {
+	address, err := channel.addressOf(friendnumber)
+	if err != nil {
+		channel.logger.Warn("OnNameChange:", err)
+		return
+	}
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch(address, func() { channel.handler().OnNameChange(address, name) })
+}
+
+/*
+onFriendStatusMessageChanges is called when a friend changes their status
+message.
+*/
+func (channel *Channel) onFriendStatusMessageChanges(_ *gotox.Tox, friendnumber uint32, message string) {
+	address, err := channel.addressOf(friendnumber)
+	if err != nil {
+		channel.logger.Warn("OnStatusMessageChange:", err)
+		return
+	}
+	// all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+	channel.dispatch(address, func() { channel.handler().OnStatusMessageChange(address, message) })
 }
 
 /*
@@ -238,9 +779,13 @@ onFileRecvControl is called when a file control packet is received.
 func (channel *Channel) onFileRecvControl(_ *gotox.Tox, friendnumber uint32, filenumber uint32, fileControl gotox.ToxFileControl) {
 	// we only explicitely need to handle cancel because we then have to remove resources
 	if fileControl == gotox.TOX_FILE_CONTROL_CANCEL {
-		trans, exists := channel.transfers[filenumber]
+		// an offer that was never decided on is simply withdrawn
+		if channel.incoming.removeFile(friendnumber, filenumber) {
+			return
+		}
+		trans, exists := channel.transfers.get(filenumber)
 		if !exists {
-			log.Println(tag, "Transfer wasn't even tracked, ignoring!", filenumber)
+			channel.logger.Warn("Transfer wasn't even tracked, ignoring!", filenumber)
 			// if it doesn't exist, ignore!
 			return
 		}
@@ -249,20 +794,13 @@ func (channel *Channel) onFileRecvControl(_ *gotox.Tox, friendnumber uint32, fil
 		// get address
 		address, err := channel.addressOf(friendnumber)
 		if err != nil {
-			log.Println(tag, "OnFileCanceled:", err)
+			channel.logger.Warn("OnFileCanceled:", err)
 			return
 		}
 		// remember to remove from sendActive IF it existed!
-		if _, exists := channel.sendActive[address]; exists {
-			delete(channel.sendActive, address)
-		}
-		// call callback
-		if channel.callbacks != nil {
-			// all real callbacks are run in separate go routines to keep ToxCore none blocking!
-			go channel.callbacks.OnFileCanceled(address, trans.path)
-		} else {
-			log.Println(tag, "No callback for OnFileCanceled registered!")
-		}
+		channel.transfers.removeActive(address)
+		// call callback: all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+		channel.dispatch(address, func() { channel.handler().OnFileCanceled(address, trans.path) })
 	}
 }
 
@@ -273,42 +811,76 @@ for reception of chunks.
 func (channel *Channel) onFileRecv(_ *gotox.Tox, friendnumber uint32, fileNumber uint32, kind gotox.ToxFileKind, filesize uint64, filename string) {
 	// we're not interested in avatars
 	if kind != gotox.TOX_FILE_KIND_DATA {
-		log.Println(tag, "Ignoring non data file transfer!")
+		channel.logger.Warn("Ignoring non data file transfer!")
 		// send cancel so that the other client knows that we blocked it
 		channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
 		return
 	}
-	// this requires callbacks to be registered
-	if channel.callbacks == nil {
-		// required for receiving files
-		log.Println(tag, "No callback for OnAllowFile registered!")
-		return
-	}
 	// address
 	address, err := channel.addressOf(friendnumber)
 	if err != nil {
-		log.Println(tag, err.Error())
-		address = illegalAddress
+		channel.logger.Warn("OnAllowFile:", err)
+		channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		return
 	}
-	// use callback to check whether to accept from Tinzenite NOTE: this one blocks... :(
-	accept, path := channel.callbacks.OnAllowFile(address, filename)
-	if !accept {
+	if channel.side.isBlocked(address) {
+		channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
 		return
 	}
+	// park the offer so that the decision can be made without stalling Tox
+	id := channel.incoming.add(IncomingFile{
+		Address: address,
+		Name:    filename,
+		Size:    filesize,
+		friend:  friendnumber,
+		file:    fileNumber}, channel.options.IncomingTTL)
+	channel.dispatch(address, func() {
+		accept, path := channel.handler().OnAllowFile(address, filename)
+		var err error
+		switch {
+		case !accept:
+			err = channel.RejectIncoming(id)
+		case path != "":
+			err = channel.AcceptIncoming(id, path)
+		}
+		// the offer may have been withdrawn in the meantime
+		if err != nil && !errors.Is(err, ErrNoOffer) {
+			channel.logger.Warn("OnAllowFile:", err)
+		}
+	})
+}
+
+/*
+acceptIncoming writes the offered file to the given path and lets the other side
+start sending.
+*/
+func (channel *Channel) acceptIncoming(offer IncomingFile, path string, policy SyncPolicy) error {
 	// create file at correct location
 	/*TODO how are pause & resume handled? FIXME*/
 	f, err := os.Create(path)
 	if err != nil {
-		log.Println(tag, "Creating file to write receival of data to failed!", err)
+		channel.tox.FileControl(offer.friend, offer.file, gotox.TOX_FILE_CONTROL_CANCEL)
+		return err
 	}
 	// create transfer object
-	channel.transfers[fileNumber] = createTransfer(path, filename, friendnumber, f, filesize, func(status State) {
+	tran := createTransfer(path, offer.Name, offer.friend, f, offer.Size, func(status State) {
 		if status != StSuccess {
-			log.Println("Transfer: sending failed: "+status.String()+"!", path)
+			channel.logger.Warn("Transfer: sending failed: "+status.String()+"!", path)
 		}
-	})
+	}, channel.logger)
+	tran.buffer = channel.options.WriteBuffer
+	tran.sync = policy
+	tran.syncEvery = channel.options.SyncEvery
+	tran.span = channel.startSpan("transfer.receive", "address", offer.Address.String(), "path", path, "size", formatUint(offer.Size))
+	channel.transfers.add(offer.file, tran)
 	// accept file send request if we come to here
-	channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_RESUME)
+	err = channel.tox.FileControl(offer.friend, offer.file, gotox.TOX_FILE_CONTROL_RESUME)
+	if err != nil {
+		channel.closeTransfer(offer.file, StFailed)
+		return err
+	}
+	channel.emit(Event{Kind: EvTransferStarted, Address: offer.Address, Path: path})
+	return nil
 }
 
 /*
@@ -316,20 +888,33 @@ onFileRecvChunk is called when a chunk of a file is received. Writes the data to
 the correct file.
 */
 func (channel *Channel) onFileRecvChunk(_ *gotox.Tox, friendnumber uint32, fileNumber uint32, position uint64, data []byte) {
-	tran, exists := channel.transfers[fileNumber]
+	tran, exists := channel.transfers.get(fileNumber)
 	if !exists {
 		// ignore zero length chunk that is sent to signal a complete transfer
 		if len(data) == 0 {
 			return
 		}
-		log.Println(tag, "Receive transfer doesn't seem to exist!", fileNumber)
+		channel.logger.Warn("Receive transfer doesn't seem to exist!", fileNumber)
 		// send that we won't be accepting this transfer after all
 		channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
 		// and we're done
 		return
 	}
-	// write date to disk
-	tran.file.WriteAt(data, (int64)(position))
+	channel.logger.Debug("Received chunk of", len(data), "bytes at", position, "for", tran.path)
+	// write date to disk, collecting small chunks first
+	start := time.Now()
+	written, err := tran.write(position, data)
+	if written {
+		channel.timings.diskWrite.observeSince(start)
+	}
+	if err != nil {
+		channel.logger.Error("Error writing file:", err)
+		// the file is incomplete, so the transfer can't succeed anymore
+		channel.tox.FileControl(friendnumber, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		channel.closeTransfer(fileNumber, StFailed)
+		return
+	}
+	atomic.AddUint64(&channel.counters.bytesReceived, uint64(len(data)))
 	// update progress
 	tran.SetProgress(position + uint64(len(data)))
 	// this means the file has been completey received
@@ -339,16 +924,12 @@ func (channel *Channel) onFileRecvChunk(_ *gotox.Tox, friendnumber uint32, fileN
 		address, _ := channel.addressOf(friendnumber)
 		name := pathelements[len(pathelements)-1]
 		path := strings.Join(pathelements, "/")
-		// close & remove transfer
-		channel.closeTransfer(fileNumber, StSuccess)
-		// call callback
-		if channel.callbacks != nil {
-			// all real callbacks are run in separate go routines to keep ToxCore none blocking!
-			go channel.callbacks.OnFileReceived(address, path, name)
-		} else {
-			// this shouldn't happen as file can only be received with callbacks, but let us be sure
-			log.Println(tag, "No callback for OnFileReceived registered!")
+		// close & remove transfer, writing out what is still buffered
+		if channel.closeTransfer(fileNumber, StSuccess) != StSuccess {
+			return
 		}
+		// call callback: all real callbacks are dispatched to the workers to keep ToxCore none blocking!
+		channel.dispatch(address, func() { channel.handler().OnFileReceived(address, path, name) })
 	}
 }
 
@@ -356,21 +937,21 @@ func (channel *Channel) onFileRecvChunk(_ *gotox.Tox, friendnumber uint32, fileN
 onFileChunkRequest is called when a chunk must be sent.
 */
 func (channel *Channel) onFileChunkRequest(_ *gotox.Tox, friendNumber uint32, fileNumber uint32, position uint64, length uint64) {
-	trans, exists := channel.transfers[fileNumber]
+	trans, exists := channel.transfers.get(fileNumber)
 	// sanity check
 	if !exists {
-		log.Println(tag, "Send transfer doesn't seem to exist!", fileNumber)
+		channel.logger.Warn("Send transfer doesn't seem to exist!", fileNumber)
 		return
 	}
 	// get address for working with sendTransfer
 	address, _ := channel.addressOf(friendNumber)
 	// if this callback is called the send transfer is active, so make sure the sendTransfer doesn't time out
-	sendTran, exists := channel.sendActive[address]
+	sendTran, exists := channel.transfers.activeOf(address)
 	if !exists {
-		log.Println(tag, "WARNING: sending timeout can not be stopped!")
+		channel.logger.Warn("Sending timeout can not be stopped!")
 	} else {
 		// set started to true since we're actually sending data
-		sendTran.started = true
+		sendTran.start()
 	}
 	// ensure that length is valid
 	if length+position > trans.size {
@@ -381,23 +962,190 @@ func (channel *Channel) onFileChunkRequest(_ *gotox.Tox, friendNumber uint32, fi
 		// close & remove transfer
 		channel.closeTransfer(fileNumber, StSuccess)
 		// remember to remove from sendActive IF it existed!
-		if _, exists := channel.sendActive[address]; exists {
-			delete(channel.sendActive, address)
-		}
+		channel.transfers.removeActive(address)
 		return
 	}
-	// get bytes to send
-	data := make([]byte, length)
-	_, err := trans.file.ReadAt(data, int64(position))
-	if err != nil {
-		fmt.Println(tag, "Error reading file:", err)
+	request := chunkRequest{friend: friendNumber, fileNumber: fileNumber, position: position, length: length, requested: time.Now()}
+	// if high priority messages wait or the rate limit doesn't allow sending now defer the chunk (keeping the order)
+	if len(channel.deferred) > 0 || channel.outbox.hasHigh() || !channel.limit.take(length) {
+		channel.deferred = append(channel.deferred, request)
 		return
 	}
+	channel.sendChunk(trans, request)
+}
+
+/*
+sendChunk reads the requested chunk from the file and sends it. Transient send
+errors cause the chunk to be served again later, fatal ones fail the transfer.
+Returns false if the chunk was deferred for a retry.
+*/
+func (channel *Channel) sendChunk(trans *transfer, request chunkRequest) bool {
+	// get bytes to send, the buffer can be reused once Tox has it
+	data := getChunk(request.length)
+	defer putChunk(data)
+	start := time.Now()
+	err := trans.readChunk(request.position, data)
+	channel.timings.diskRead.observeSince(start)
+	if err != nil {
+		channel.logger.Error("Error reading file:", err)
+		channel.failChunk(request)
+		return true
+	}
+	channel.logger.Debug("Sending chunk of", len(data), "bytes at", request.position, "for", trans.path)
 	// send
-	err = channel.tox.FileSendChunk(friendNumber, fileNumber, position, data)
+	start = time.Now()
+	err = channel.tox.FileSendChunk(request.friend, request.fileNumber, request.position, data)
+	channel.timings.toxSend.observeSince(start)
 	if err != nil {
-		log.Println(tag, "File send error: ", err)
+		// gotox doesn't report the error code, so decide by whether the friend is still reachable
+		status, statusErr := channel.tox.FriendGetConnectionStatus(request.friend)
+		if statusErr != nil || status == gotox.TOX_CONNECTION_NONE || trans.retries >= maxChunkRetries {
+			channel.logger.Error("File send error, failing transfer:", err)
+			channel.failChunk(request)
+			return true
+		}
+		// transient (for example full send queue): serve again before anything else
+		trans.retries++
+		inc(&channel.counters.chunkRetries)
+		channel.deferred = append([]chunkRequest{request}, channel.deferred...)
+		return false
 	}
+	trans.retries = 0
+	channel.timings.chunkService.observeSince(request.requested)
+	atomic.AddUint64(&channel.counters.bytesSent, uint64(len(data)))
 	// update progress
-	trans.SetProgress(position + length)
+	trans.SetProgress(request.position + request.length)
+	return true
+}
+
+/*
+failChunk cancels and closes the transfer of the given chunk after a fatal error.
+*/
+func (channel *Channel) failChunk(request chunkRequest) {
+	inc(&channel.counters.chunkFailures)
+	channel.tox.FileControl(request.friend, request.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+	channel.closeTransfer(request.fileNumber, StFailed)
+	address, err := channel.addressOf(request.friend)
+	if err != nil {
+		return
+	}
+	// remember to remove from sendActive IF it existed!
+	channel.transfers.removeActive(address)
+}
+
+/*
+serveOutbox sends the queued messages of the given priority. High priority
+messages may go into debt with the rate limit, bulk messages may not.
+*/
+func (channel *Channel) serveOutbox(priority Priority) {
+	for {
+		out, exists := channel.outbox.peek(priority)
+		if !exists {
+			return
+		}
+		size := uint64(len(out.message))
+		if priority == PrHigh && !channel.limit.force(size) {
+			return
+		}
+		if priority != PrHigh && !channel.limit.take(size) {
+			return
+		}
+		channel.outbox.pop(priority)
+		_, err := channel.tox.FriendSendMessage(out.friend, gotox.TOX_MESSAGE_TYPE_NORMAL, out.message)
+		if err != nil {
+			channel.logger.Error("Sending queued message failed, dropping:", err)
+			continue
+		}
+		inc(&channel.counters.messagesSent)
+	}
+}
+
+/*
+serveDeferred sends as many of the chunks held back by the rate limit as it
+currently allows, in the order they were requested.
+*/
+func (channel *Channel) serveDeferred() {
+	for len(channel.deferred) > 0 {
+		request := channel.deferred[0]
+		trans, exists := channel.transfers.get(request.fileNumber)
+		// drop chunks of transfers that have been closed in the meantime
+		if !exists || trans.friend != request.friend {
+			channel.deferred = channel.deferred[1:]
+			continue
+		}
+		if !channel.limit.take(request.length) {
+			return
+		}
+		channel.deferred = channel.deferred[1:]
+		// stop for now if the chunk must be retried
+		if !channel.sendChunk(trans, request) {
+			return
+		}
+	}
+}
+
+/*
+onFriendLosslessPacket is called when a custom lossless packet is received.
+Dispatches stream frames to the stream of the address.
+*/
+func (channel *Channel) onFriendLosslessPacket(_ *gotox.Tox, friendnumber uint32, data []byte) {
+	if len(data) < 2 || data[0] != packetStream {
+		channel.logger.Debug("Ignoring unknown lossless packet!")
+		return
+	}
+	address, err := channel.addressOf(friendnumber)
+	if err != nil {
+		channel.logger.Warn("Stream:", err)
+		return
+	}
+	// copy payload as the underlying data belongs to Tox
+	payload := make([]byte, len(data)-2)
+	copy(payload, data[2:])
+	var s *stream
+	if data[1] == frameCredit {
+		// credit only concerns existing streams, don't start a new one for it
+		channel.streamMut.Lock()
+		s = channel.streams[address]
+		channel.streamMut.Unlock()
+		if s == nil {
+			return
+		}
+	} else {
+		s = channel.streamOf(address, friendnumber)
+	}
+	s.receive(data[1], payload)
+	// a stream closed by the other side is done, new data starts a new one
+	if data[1] == frameClose {
+		channel.removeStream(s)
+	}
+}
+
+/*
+onFriendLossyPacket is called when a custom lossy packet is received. Answers
+pings and hands pongs to the pinger.
+*/
+func (channel *Channel) onFriendLossyPacket(_ *gotox.Tox, friendnumber uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	switch data[0] {
+	case packetPing:
+		// echo the nonce back
+		reply := make([]byte, len(data))
+		copy(reply, data)
+		reply[0] = packetPong
+		err := channel.tox.FriendSendLossyPacket(friendnumber, reply)
+		if err != nil {
+			channel.logger.Warn("Failed to answer ping:", err)
+		}
+	case packetPong:
+		address, err := channel.addressOf(friendnumber)
+		if err != nil {
+			channel.logger.Debug("Pong:", err)
+			return
+		}
+		channel.pings.receive(address, data[1:])
+	default:
+		channel.logger.Debug("Ignoring unknown lossy packet!")
+	}
 }
@@ -1,58 +1,288 @@
 package channel
 
 import (
+	"context"
 	"encoding/hex"
-	"log"
+	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/codedust/go-tox"
 )
 
 /*
-Close shuts down the channel.
+Close shuts down the channel. Transfers are canceled first, then the shutdown
+hooks are run, then Tox is killed. Calling it again only waits for the first
+call to finish. Afterwards all methods fail with ErrClosed.
 */
 func (channel *Channel) Close() {
-	// send stop signal
-	channel.stop <- true
-	// wait for it to close
-	channel.wg.Wait()
-	// kill tox
-	channel.tox.Kill()
+	channel.CloseWithContext(context.Background())
+}
+
+/*
+CloseWithContext shuts down the channel like Close, but returns the context error
+if the context expires first. The shutdown then continues in the background.
+*/
+func (channel *Channel) CloseWithContext(ctx context.Context) error {
+	channel.closeOnce.Do(func() {
+		// send stop signal
+		close(channel.stop)
+		channel.routines.start(subsystemShutdown, func() {
+			// wait for it to close
+			channel.wg.Wait()
+			channel.shutdown()
+			close(channel.done)
+		})
+	})
+	select {
+	case <-channel.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+CloseGraceful stops accepting new messages, transfers, and friend requests, then
+waits up to the given timeout for running transfers and queued messages to
+finish before closing the channel like Close. Returns the final ToxData, taken
+after the wait, for persisting.
+*/
+func (channel *Channel) CloseGraceful(timeout time.Duration) ([]byte, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
+	atomic.StoreInt32(&channel.closing, 1)
+	deadline := time.After(timeout)
+	for waiting := true; waiting; {
+		done := make(chan bool, 1)
+		select {
+		case channel.idleChecks <- done:
+			if <-done {
+				waiting = false
+				continue
+			}
+		case <-channel.stopped:
+			waiting = false
+			continue
+		case <-deadline:
+			waiting = false
+			continue
+		}
+		select {
+		case <-time.After(channel.options.IterateInterval):
+		case <-deadline:
+			waiting = false
+		}
+	}
+	data, err := channel.ToxData()
+	channel.Close()
+	return data, err
+}
+
+/*
+shutdown cleans up once the background thread has stopped.
+*/
+func (channel *Channel) shutdown() {
 	// clean all file transfers
-	for _, transfer := range channel.transfers {
+	for fileNumber := range channel.transfers.all() {
+		if transfer, exists := channel.transfers.remove(fileNumber); exists {
+			transfer.Close(StCanceled)
+		}
+	}
+	for _, transfer := range channel.parked.clear() {
 		transfer.Close(StCanceled)
 	}
-	log.Println(tag, "Closed.")
+	// run shutdown hooks while Tox is still alive
+	channel.hookMut.Lock()
+	hooks := channel.hooks
+	channel.hookMut.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	// persist the final state
+	channel.save()
+	// give anything the hooks sent a chance to leave
+	for i := 0; i < flushIterations; i++ {
+		channel.tox.Iterate()
+		time.Sleep(channel.options.IterateInterval)
+	}
+	if channel.bootSpan != nil {
+		channel.bootSpan.End(ErrClosed)
+		channel.bootSpan = nil
+	}
+	// kill tox once no call is using it, calls that got past isClosed then fail with ErrClosed
+	atomic.StoreInt32(&channel.closed, 1)
+	channel.tox.Kill()
+	// let the callbacks that are still waiting run, then stop the workers
+	channel.dispatcher.stop()
+	channel.logger.Info("Closed.")
+}
+
+/*
+OnShutdown registers a function that is called during Close after all transfers
+have been canceled but before Tox is killed. This is the place to persist the
+ToxData, flush journals, or notify peers. Hooks are called in the order they
+were registered.
+*/
+func (channel *Channel) OnShutdown(hook func()) {
+	channel.hookMut.Lock()
+	defer channel.hookMut.Unlock()
+	channel.hooks = append(channel.hooks, hook)
 }
 
 /*
 ConnectionAddress of the Tox instance. This is the address that can be used to
-send friend requests to.
+send friend requests to. It includes the nospam value and thus changes when the
+nospam is changed with SelfSetNospam.
 */
 func (channel *Channel) ConnectionAddress() (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
 	address, err := channel.tox.SelfGetAddress()
 	if err != nil {
-		return "", err
+		return "", toxErr("SelfGetAddress", err)
 	}
 	return hex.EncodeToString(address), nil
 }
 
 /*
-Address of the Tox instance.
+Address of the Tox instance. This is the public key which, unlike the
+ConnectionAddress, stays stable when the nospam is changed.
 */
-func (channel *Channel) Address() (string, error) {
-	address, err := channel.tox.SelfGetAddress()
+func (channel *Channel) Address() (Address, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
+	id, err := channel.tox.SelfGetAddress()
 	if err != nil {
-		return "", err
+		return "", toxErr("SelfGetAddress", err)
+	}
+	return addressOfKey(id), nil
+}
+
+/*
+SelfSetNospam sets the nospam part of the ConnectionAddress. Changing it
+invalidates the previous ConnectionAddress for new friend requests, which is
+useful if it has been shared too widely. Existing friends are not affected and
+the Address stays the same.
+*/
+func (channel *Channel) SelfSetNospam(nospam uint32) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	return toxErr("SelfSetNospam", channel.tox.SelfSetNospam(nospam))
+}
+
+/*
+SelfGetNospam returns the nospam part of the ConnectionAddress.
+*/
+func (channel *Channel) SelfGetNospam() (uint32, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	nospam, err := channel.tox.SelfGetNospam()
+	return nospam, toxErr("SelfGetNospam", err)
+}
+
+/*
+UDPPort returns the UDP port Tox actually bound, for configuring port
+forwarding.
+*/
+func (channel *Channel) UDPPort() (uint16, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	port, err := channel.tox.SelfGetUDPPort()
+	return port, toxErr("SelfGetUDPPort", err)
+}
+
+/*
+TCPPort returns the port of the TCP relay Tox offers to others. Fails if the TCP
+server is disabled, see Options.TCPPort.
+*/
+func (channel *Channel) TCPPort() (uint16, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	port, err := channel.tox.SelfGetTCPPort()
+	return port, toxErr("SelfGetTCPPort", err)
+}
+
+/*
+DHTKey returns the hex encoded DHT public key of the channel. Together with the
+UDP port it allows others to use this channel as a bootstrap node.
+*/
+func (channel *Channel) DHTKey() (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
+	key, err := channel.tox.SelfGetDhtID()
+	if err != nil {
+		return "", toxErr("SelfGetDhtID", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+/*
+SelfSetName changes the name of the channel as seen by all friends.
+*/
+func (channel *Channel) SelfSetName(name string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if name == "" {
+		return ErrEmptyName
+	}
+	return toxErr("SelfSetName", channel.tox.SelfSetName(name))
+}
+
+/*
+SelfName returns the name of the channel.
+*/
+func (channel *Channel) SelfName() (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
+	name, err := channel.tox.SelfGetName()
+	return name, toxErr("SelfGetName", err)
+}
+
+/*
+SelfSetStatusMessage publishes the given status message to all friends. This can
+be used to publish the current state of the peer, for example the sync state.
+*/
+func (channel *Channel) SelfSetStatusMessage(message string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	return toxErr("SelfSetStatusMessage", channel.tox.SelfSetStatusMessage(message))
+}
+
+/*
+SelfStatusMessage returns the status message currently published.
+*/
+func (channel *Channel) SelfStatusMessage() (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
 	}
-	return hex.EncodeToString(address)[:64], nil
+	message, err := channel.tox.SelfGetStatusMessage()
+	return message, toxErr("SelfGetStatusMessage", err)
 }
 
 /*
 OnlineAddresses returns a list of all addresses currently online.
 */
-func (channel *Channel) OnlineAddresses() ([]string, error) {
-	var onlineAddresses []string
+func (channel *Channel) OnlineAddresses() ([]Address, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
+	var onlineAddresses []Address
 	addresses, err := channel.FriendAddresses()
 	if err != nil {
 		return nil, err
@@ -72,219 +302,1413 @@ func (channel *Channel) OnlineAddresses() ([]string, error) {
 /*
 FriendAddresses returns a list of addresses of all friends.
 */
-func (channel *Channel) FriendAddresses() ([]string, error) {
+func (channel *Channel) FriendAddresses() ([]Address, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
 	friends, err := channel.tox.SelfGetFriendlist()
 	if err != nil {
-		return nil, err
+		return nil, toxErr("SelfGetFriendlist", err)
 	}
-	var addresses []string
+	var addresses []Address
 	for _, friend := range friends {
-		address, err := channel.tox.FriendGetPublickey(friend)
+		publicKey, err := channel.tox.FriendGetPublickey(friend)
 		if err != nil {
-			return nil, err
+			return nil, toxErr("FriendGetPublickey", err)
 		}
-		addresses = append(addresses, hex.EncodeToString(address))
+		addresses = append(addresses, addressOfKey(publicKey))
 	}
 	return addresses, nil
 }
 
 /*
-ToxData returns the underlying current representation of the tox data. Can be
-used to store a Tox instance to disk.
+Friends returns the details of all friends in one pass.
 */
-func (channel *Channel) ToxData() ([]byte, error) {
-	return channel.tox.GetSavedata()
+func (channel *Channel) Friends() ([]FriendInfo, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
+	friends, err := channel.tox.SelfGetFriendlist()
+	if err != nil {
+		return nil, toxErr("SelfGetFriendlist", err)
+	}
+	var infos []FriendInfo
+	for _, friend := range friends {
+		publicKey, err := channel.tox.FriendGetPublickey(friend)
+		if err != nil {
+			return nil, toxErr("FriendGetPublickey", err)
+		}
+		info := FriendInfo{Address: addressOfKey(publicKey)}
+		info.Alias, _ = channel.side.aliasOf(info.Address)
+		info.Name, err = channel.tox.FriendGetName(friend)
+		if err != nil {
+			return nil, toxErr("FriendGetName", err)
+		}
+		info.StatusMessage, err = channel.tox.FriendGetStatusMessage(friend)
+		if err != nil {
+			return nil, toxErr("FriendGetStatusMessage", err)
+		}
+		status, err := channel.tox.FriendGetStatus(friend)
+		if err != nil {
+			return nil, toxErr("FriendGetStatus", err)
+		}
+		info.Status = userStatusOf(status)
+		connection, err := channel.tox.FriendGetConnectionStatus(friend)
+		if err != nil {
+			return nil, toxErr("FriendGetConnectionStatus", err)
+		}
+		info.ConnectionType = connectionTypeOf(connection)
+		info.Online = connection != gotox.TOX_CONNECTION_NONE
+		infos = append(infos, info)
+	}
+	return infos, nil
 }
 
 /*
-Send a message to the given peer address.
+ExportFriends returns a portable JSON list of the addresses and aliases of all
+friends, independent of the ToxData. Use ImportFriends to restore it on another
+device.
 */
-func (channel *Channel) Send(address, message string) error {
-	if ok, err := channel.IsAddressOnline(address); !ok {
-		if err != nil {
-			return err
-		}
-		return errOffline
+func (channel *Channel) ExportFriends() ([]byte, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
 	}
-	// find friend id to send to
-	id, err := channel.friendNumberOf(address)
+	addresses, err := channel.FriendAddresses()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	/*
-		if channel.log {
-			log.Println("Channel: sending", "<"+message+">", "to", address, ".")
-		}
-	*/
-	// returns message ID but we currently don't use it
-	_, err = channel.tox.FriendSendMessage(id, gotox.TOX_MESSAGE_TYPE_NORMAL, message)
-	return err
+	list := exportedFriends{Friends: []exportedFriend{}}
+	for _, address := range addresses {
+		alias, _ := channel.side.aliasOf(address)
+		list.Friends = append(list.Friends, exportedFriend{Address: address, Alias: alias})
+	}
+	return json.Marshal(list)
 }
 
 /*
-SendFile starts a file transfer to the given address. Will directly begin the
-transfer!
+ImportFriends adds all friends of a list created by ExportFriends that aren't
+friends yet and sets their aliases.
 */
-func (channel *Channel) SendFile(address string, path string, identification string, f func(status State)) error {
-	if ok, _ := channel.IsAddressOnline(address); !ok {
-		return errOffline
+func (channel *Channel) ImportFriends(data []byte) error {
+	if channel.isClosed() {
+		return ErrClosed
 	}
-	// find friend id to send to
-	friendID, err := channel.friendNumberOf(address)
+	var list exportedFriends
+	err := json.Unmarshal(data, &list)
 	if err != nil {
 		return err
 	}
-	// get file
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+	for _, friend := range list.Friends {
+		isFriend, err := channel.IsFriend(friend.Address)
+		if err != nil {
+			return err
+		}
+		if !isFriend {
+			err = channel.AcceptConnection(friend.Address)
+			if err != nil {
+				return err
+			}
+		}
+		if friend.Alias != "" {
+			channel.side.setAlias(friend.Address, friend.Alias)
+		}
 	}
-	// do NOT close file! must be done elsewhere since we may need it later
-	// get file size
-	stat, err := file.Stat()
-	if err != nil {
-		file.Close()
-		return err
+	return nil
+}
+
+/*
+ToxData returns the underlying current representation of the tox data together
+with the channel data such as aliases. Can be used to store a Tox instance to
+disk and passed to Create to restore it. If a Passphrase is set in the options
+the data is encrypted.
+*/
+func (channel *Channel) ToxData() ([]byte, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
 	}
-	size := uint64(stat.Size())
-	// create transfer object
-	tran := createTransfer(path, identification, friendID, file, size, f)
-	// create chan if not already exists
-	_, exists := channel.sending[address]
-	if !exists {
-		// TODO make chan size setable etc
-		channel.sending[address] = make(chan *transfer, 64)
+	toxdata, err := channel.tox.GetSavedata()
+	if err != nil {
+		return nil, toxErr("GetSavedata", err)
 	}
-	// write to queue if possible
-	select {
-	case channel.sending[address] <- tran:
-		return nil
-	default:
-		// if not return error so caller knows it failed
-		return errSendBufferFull
+	data, err := channel.side.pack(toxdata)
+	if err != nil || channel.options.Passphrase == "" {
+		return data, err
 	}
+	return EncryptToxData(data, channel.options.Passphrase)
 }
 
 /*
-CancelFileTransfer cancels the file transfer that is writting to the given path.
+SetAlias sets a user chosen name for the given address, independent of the name
+the friend has set. The alias is persisted with the ToxData. An empty alias
+removes it.
 */
-func (channel *Channel) CancelFileTransfer(path string) error {
-	// find fileNumber & transfer via file name
-	var found bool
-	var fileNumber uint32
-	var transfer *transfer
-	for thisNumber, thisTransfer := range channel.transfers {
-		if thisTransfer.path == path {
-			found = true
-			fileNumber = thisNumber
-			transfer = thisTransfer
-			break
-		}
+func (channel *Channel) SetAlias(address Address, alias string) error {
+	if channel.isClosed() {
+		return ErrClosed
 	}
-	// if none found return error
-	if !found {
-		return errTransferNotFound
+	if _, err := channel.friendNumberOf(address); err != nil {
+		return err
 	}
-	// cancel transfer
-	channel.tox.FileControl(transfer.friend, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
-	// close transfer
-	transfer.Close(StCanceled)
-	// remove object
-	delete(channel.transfers, fileNumber)
+	channel.side.setAlias(address, alias)
 	return nil
 }
 
 /*
-AcceptConnection accepts the given address as a connection partner.
+SetPeerMeta stores a small value under the given key for the given address, for
+example the last synced version or capabilities of the peer. The values are
+persisted with the ToxData. An empty value removes the key.
 */
-func (channel *Channel) AcceptConnection(address string) error {
-	publicKey, err := hex.DecodeString(address)
-	if err != nil {
+func (channel *Channel) SetPeerMeta(address Address, key, value string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if _, err := channel.friendNumberOf(address); err != nil {
 		return err
 	}
-	// ignore friendnumber
-	_, err = channel.tox.FriendAddNorequest(publicKey)
-	return err
+	channel.side.setMeta(address, key, value)
+	return nil
 }
 
 /*
-RequestConnection sends a friend request to the given address with the sending
-peer information as the message for bootstrapping.
+PeerMeta returns the value stored under the given key for the given address.
 */
-func (channel *Channel) RequestConnection(address, message string) error {
-	publicKey, err := hex.DecodeString(address)
-	if err != nil {
-		return err
+func (channel *Channel) PeerMeta(address Address, key string) (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
 	}
-	// send non blocking friend request
-	_, err = channel.tox.FriendAdd(publicKey, message)
-	return err
+	value, exists := channel.side.metaOf(address, key)
+	if !exists {
+		return "", ErrNoMeta
+	}
+	return value, nil
 }
 
 /*
-RemoveConnection removes a friend from the friendlist, effectivly terminating
-the connection.
+AliasOf returns the alias set for the given address.
 */
-func (channel *Channel) RemoveConnection(address string) error {
-	num, err := channel.friendNumberOf(address)
-	if err != nil {
-		return err
+func (channel *Channel) AliasOf(address Address) (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
 	}
-	return channel.tox.FriendDelete(num)
+	alias, exists := channel.side.aliasOf(address)
+	if !exists {
+		return "", ErrNoAlias
+	}
+	return alias, nil
 }
 
 /*
-IsAddressOnline checks whether the given address is currently reachable.
+Send a message to the given peer address.
 */
-func (channel *Channel) IsAddressOnline(address string) (bool, error) {
-	num, err := channel.friendNumberOf(address)
+func (channel *Channel) Send(address Address, message string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if channel.isClosing() {
+		return ErrClosing
+	}
+	if ok, err := channel.IsAddressOnline(address); !ok {
+		if err != nil {
+			return err
+		}
+		return ErrOffline
+	}
+	// find friend id to send to
+	id, err := channel.friendNumberOf(address)
 	if err != nil {
-		return false, err
+		return err
 	}
-	status, err := channel.tox.FriendGetConnectionStatus(num)
+	channel.logger.Debug("Sending", "<"+message+">", "to", address+".")
+	message, err = channel.seal(address, message)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return status != gotox.TOX_CONNECTION_NONE, nil
+	// messages have priority over file chunks but still count towards the limit
+	if !channel.limit.force(uint64(len(message))) {
+		return ErrRateLimited
+	}
+	// returns message ID but we currently don't use it
+	_, err = channel.tox.FriendSendMessage(id, gotox.TOX_MESSAGE_TYPE_NORMAL, message)
+	if err != nil {
+		return toxErr("FriendSendMessage", err)
+	}
+	inc(&channel.counters.messagesSent)
+	return nil
 }
 
 /*
-NameOf the key associated to the given address.
+SendWithContext sends a message like Send, but waits for the rate limit instead
+of failing until the context expires.
 */
-func (channel *Channel) NameOf(address string) (string, error) {
-	num, err := channel.friendNumberOf(address)
-	if err != nil {
-		return "", err
+func (channel *Channel) SendWithContext(ctx context.Context, address Address, message string) error {
+	if channel.isClosed() {
+		return ErrClosed
 	}
-	name, err := channel.tox.FriendGetName(num)
-	if err != nil {
-		return "", err
+	for {
+		err := channel.Send(address, message)
+		if !errors.Is(err, ErrRateLimited) {
+			return err
+		}
+		select {
+		case <-time.After(channel.options.IterateInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return name, nil
 }
 
 /*
-IsOnline referes to the connection status of the channel.
+SendReliable sends a message to the given peer address and blocks until the
+peer has acknowledged receiving it via a read receipt or the context expires.
+Use this for critical control messages.
 */
-func (channel *Channel) IsOnline() (bool, error) {
-	status, err := channel.tox.SelfGetConnectionStatus()
+func (channel *Channel) SendReliable(ctx context.Context, address Address, message string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if channel.isClosing() {
+		return ErrClosing
+	}
+	if ok, err := channel.IsAddressOnline(address); !ok {
+		if err != nil {
+			return err
+		}
+		return ErrOffline
+	}
+	// find friend id to send to
+	id, err := channel.friendNumberOf(address)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if status != gotox.TOX_CONNECTION_NONE {
-		return true, nil
+	message, err = channel.seal(address, message)
+	if err != nil {
+		return err
+	}
+	if !channel.limit.force(uint64(len(message))) {
+		return ErrRateLimited
+	}
+	span := channel.startSpan("message.reliable", "address", address.String())
+	done := make(chan bool, 1)
+	// hold lock while sending so that the receipt can not arrive before we wait for it
+	channel.receiptMut.Lock()
+	messageID, err := channel.tox.FriendSendMessage(id, gotox.TOX_MESSAGE_TYPE_NORMAL, message)
+	if err != nil {
+		channel.receiptMut.Unlock()
+		err = toxErr("FriendSendMessage", err)
+		span.End(err)
+		return err
+	}
+	inc(&channel.counters.messagesSent)
+	key := receipt{friend: id, message: messageID}
+	channel.receipts[key] = done
+	channel.receiptMut.Unlock()
+	// wait for receipt or context
+	select {
+	case <-done:
+		span.End(nil)
+		return nil
+	case <-ctx.Done():
+		channel.receiptMut.Lock()
+		delete(channel.receipts, key)
+		channel.receiptMut.Unlock()
+		span.End(ctx.Err())
+		return ctx.Err()
 	}
-	return false, nil
 }
 
 /*
-ActiveTransfers returns a map of file names and associated percentage done. By
-polling it regularly this can be used to offer feedback on long transfers.
+SendFile starts a file transfer to the given address. Will directly begin the
+transfer! If the QueueOffline option is set, transfers to offline friends are
+parked until the friend comes online or the OfflineTTL runs out. Sending the same
+path again while parked replaces the previous transfer. Like all callbacks f is
+run by the workers.
 */
-func (channel *Channel) ActiveTransfers() map[string]int {
-	list := make(map[string]int)
-	for _, transfer := range channel.transfers {
-		list[transfer.file.Name()] = transfer.Percentage()
+func (channel *Channel) SendFile(address Address, path string, identification string, f func(status State)) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	return channel.SendFileWithContext(context.Background(), address, path, identification, f)
+}
+
+/*
+SendFileWithContext starts a file transfer like SendFile. If the context expires
+before the transfer is done, the transfer is canceled.
+*/
+func (channel *Channel) SendFileWithContext(ctx context.Context, address Address, path string, identification string, f func(status State)) error {
+	return channel.sendFile(ctx, address, path, identification, 0, f)
+}
+
+/*
+SendFileWithTimeout starts a file transfer like SendFile, but with its own
+timeout for the other side to accept it instead of Options.SendTimeout.
+*/
+func (channel *Channel) SendFileWithTimeout(address Address, path string, identification string, timeout time.Duration, f func(status State)) error {
+	return channel.sendFile(context.Background(), address, path, identification, timeout, f)
+}
+
+/*
+sendFile starts a file transfer with the given start timeout, zero for the
+default.
+*/
+func (channel *Channel) sendFile(ctx context.Context, address Address, path string, identification string, timeout time.Duration, f func(status State)) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if channel.isClosing() {
+		return ErrClosing
+	}
+	online, _ := channel.IsAddressOnline(address)
+	if !online && !channel.options.QueueOffline {
+		return ErrOffline
 	}
+	// find friend id to send to
+	friendID, err := channel.friendNumberOf(address)
+	if err != nil {
+		return err
+	}
+	// get file
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// do NOT close file! must be done elsewhere since we may need it later
+	// get file size
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size := uint64(stat.Size())
+	// transfers are closed by the background thread, which must not run user code
+	done := f
+	if f != nil {
+		done = func(status State) {
+			channel.dispatch(address, func() { f(status) })
+		}
+	}
+	// create transfer object
+	tran := createTransfer(path, identification, friendID, file, size, done, channel.logger)
+	tran.ctx = ctx
+	tran.timeout = timeout
+	if channel.options.MapFiles && size > 0 {
+		tran.mapped, err = mapFile(file, size)
+		if err != nil {
+			channel.logger.Debug("Mapping file failed, reading it instead:", err)
+			err = nil
+		}
+	}
+	// the queues belong to the background thread
+	doErr := channel.do(func() {
+		if !online {
+			replaced := channel.parked.park(address, tran, channel.options.OfflineTTL)
+			if replaced != nil {
+				replaced.Close(StCanceled)
+			}
+			return
+		}
+		err = channel.enqueue(address, tran)
+	})
+	if doErr != nil {
+		tran.discard()
+		return doErr
+	}
+	if err != nil {
+		tran.discard()
+	}
+	return err
+}
+
+/*
+SendQueued queues a message to the given peer address on the lane of the given
+priority. The background thread sends high priority messages before any file
+chunks, while bulk messages are sent after them within the rate limit. Messages
+to peers that go offline while queued are dropped.
+*/
+func (channel *Channel) SendQueued(address Address, message string, priority Priority) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if channel.isClosing() {
+		return ErrClosing
+	}
+	if ok, err := channel.IsAddressOnline(address); !ok {
+		if err != nil {
+			return err
+		}
+		return ErrOffline
+	}
+	id, err := channel.friendNumberOf(address)
+	if err != nil {
+		return err
+	}
+	message, err = channel.seal(address, message)
+	if err != nil {
+		return err
+	}
+	return channel.do(func() {
+		channel.outbox.push(outgoing{friend: id, message: message}, priority)
+	})
+}
+
+/*
+OpenStream returns a socket like byte pipe to the given address built on lossless
+packets. Both sides must open the stream for the given address; data received
+before the stream is opened locally is buffered. Closing the stream notifies the
+other side, after which a new stream can be opened.
+*/
+func (channel *Channel) OpenStream(address Address) (io.ReadWriteCloser, error) {
+	if channel.isClosed() {
+		return nil, ErrClosed
+	}
+	if ok, err := channel.IsAddressOnline(address); !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrOffline
+	}
+	friend, err := channel.friendNumberOf(address)
+	if err != nil {
+		return nil, err
+	}
+	return channel.streamOf(address, friend), nil
+}
+
+/*
+Restart kills and re-creates the underlying Tox instance from its current
+savedata. Identity and friends are kept, as are queued messages, parked
+transfers, and the callbacks. Running transfers fail and all friends are
+reported offline until they reconnect.
+*/
+func (channel *Channel) Restart() error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	return channel.requestRestart(restart{done: make(chan error, 1)})
+}
+
+/*
+LoadToxData swaps the identity of the channel at runtime for the one in the
+given ToxData, for example to switch profiles or restore a backup. The old Tox
+instance is closed cleanly: its transfers, queued messages, pending requests,
+and streams are canceled. Callbacks and options are kept, so encrypted ToxData
+must use the same Passphrase.
+*/
+func (channel *Channel) LoadToxData(toxdata []byte) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	toxdata, err := channel.options.openToxData(toxdata)
+	if err != nil {
+		return err
+	}
+	toxdata, side, err := unpackSidecar(toxdata)
+	if err != nil {
+		return err
+	}
+	if toxdata == nil {
+		return ErrCorruptData
+	}
+	return channel.requestRestart(restart{toxdata: toxdata, side: side, done: make(chan error, 1)})
+}
+
+/*
+Suspend parks the background thread: Tox is neither iterated nor bootstrapped
+and no timers run until Resume is called, but all state is kept. Unlike
+GoOffline nothing at all happens in the background, which conserves battery.
+Calls that need the background thread, like Bootstrap or Restart, block until
+then.
+*/
+func (channel *Channel) Suspend() {
+	channel.suspendMut.Lock()
+	if channel.resume != nil {
+		channel.suspendMut.Unlock()
+		return
+	}
+	resume := make(chan bool)
+	channel.resume = resume
+	channel.suspendMut.Unlock()
+	select {
+	case channel.suspends <- resume:
+	case <-channel.stopped:
+	}
+}
+
+/*
+Resume the background thread after Suspend.
+*/
+func (channel *Channel) Resume() {
+	channel.suspendMut.Lock()
+	defer channel.suspendMut.Unlock()
+	if channel.resume == nil {
+		return
+	}
+	close(channel.resume)
+	channel.resume = nil
+}
+
+/*
+GoOffline pauses all networking without destroying the Tox instance: Tox is no
+longer iterated and the channel doesn't bootstrap, so friends will see it go
+offline. Queued messages and transfers wait until GoOnline is called.
+*/
+func (channel *Channel) GoOffline() {
+	atomic.StoreInt32(&channel.paused, 1)
+}
+
+/*
+GoOnline resumes networking after GoOffline.
+*/
+func (channel *Channel) GoOnline() {
+	atomic.StoreInt32(&channel.paused, 0)
+}
+
+/*
+Bootstrap forces an immediate bootstrap round, re-fetching the nodes unless
+custom ones were given in the options. Use it to reconnect right away, for
+example after the network changed. Returns ErrBootstrap if no node accepted
+the request and ErrPaused while the channel is offline by GoOffline.
+*/
+func (channel *Channel) Bootstrap(ctx context.Context) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	done := make(chan error, 1)
+	select {
+	case channel.rebootstrap <- done:
+	case <-channel.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-channel.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Ping the given address, blocking until the pong arrives or the context expires.
+Returns the round trip time. As pings are sent as lossy packets the context
+should always have a deadline.
+*/
+func (channel *Channel) Ping(ctx context.Context, address Address) (time.Duration, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	if ok, err := channel.IsAddressOnline(address); !ok {
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrOffline
+	}
+	friend, err := channel.friendNumberOf(address)
+	if err != nil {
+		return 0, err
+	}
+	span := channel.startSpan("ping", "address", address.String())
+	done := make(chan time.Duration, 1)
+	nonce, packet := channel.pings.register(address, done)
+	err = channel.tox.FriendSendLossyPacket(friend, packet)
+	if err != nil {
+		channel.pings.forget(nonce)
+		err = toxErr("FriendSendLossyPacket", err)
+		span.End(err)
+		return 0, err
+	}
+	select {
+	case rtt := <-done:
+		span.End(nil)
+		return rtt, nil
+	case <-ctx.Done():
+		channel.pings.forget(nonce)
+		span.End(ctx.Err())
+		return 0, ctx.Err()
+	}
+}
+
+/*
+LastPong returns the round trip time of the last pong received from the given
+address and when it was received. Together with the KeepaliveInterval option
+this allows detecting peers that are connected but no longer responding.
+*/
+func (channel *Channel) LastPong(address Address) (time.Duration, time.Time, error) {
+	if channel.isClosed() {
+		return 0, time.Time{}, ErrClosed
+	}
+	last, exists := channel.pings.last(address)
+	if !exists {
+		return 0, time.Time{}, ErrNoPong
+	}
+	return last.rtt, last.at, nil
+}
+
+/*
+SetBootstrapNodes replaces the nodes used for bootstrapping to the Tox network.
+*/
+func (channel *Channel) SetBootstrapNodes(nodes []Node) {
+	channel.nodeMut.Lock()
+	defer channel.nodeMut.Unlock()
+	channel.nodes = nodes
+	// start a new rotation with the new nodes
+	channel.rotation = nil
+	// the history of nodes no longer used is of no use either (nil while creating)
+	if channel.side != nil {
+		channel.side.keepNodes(nodes)
+	}
+}
+
+/*
+SetRateLimit sets the maximum outgoing bandwidth in bytes per second shared by
+messages and file transfers. Messages take priority over file chunks. A value of
+zero disables rate limiting, which is the default.
+*/
+func (channel *Channel) SetRateLimit(bytesPerSecond uint64) {
+	channel.limit.setRate(bytesPerSecond)
+}
+
+/*
+SetCipher registers the cipher to use for all messages. Both peers must use a
+compatible cipher. Setting nil disables application level encryption.
+*/
+func (channel *Channel) SetCipher(cipher Cipher) {
+	channel.cipherMut.Lock()
+	defer channel.cipherMut.Unlock()
+	channel.cipher = cipher
+}
+
+/*
+CancelFileTransfer cancels the file transfer that is writting to the given path.
+*/
+func (channel *Channel) CancelFileTransfer(path string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	err := ErrTransferNotFound
+	doErr := channel.do(func() {
+		// find fileNumber & transfer via file name
+		fileNumber, transfer, found := channel.transfers.find(path)
+		if !found {
+			return
+		}
+		channel.transfers.remove(fileNumber)
+		// cancel transfer
+		channel.tox.FileControl(transfer.friend, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		// close transfer
+		transfer.Close(StCanceled)
+		inc(&channel.counters.transfersCanceled)
+		err = nil
+	})
+	if doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+/*
+PendingIncoming returns the file offers that await a decision.
+*/
+func (channel *Channel) PendingIncoming() []IncomingFile {
+	return channel.incoming.list()
+}
+
+/*
+AcceptIncoming accepts the pending file offer of the given id, writing the file
+to the given path.
+*/
+func (channel *Channel) AcceptIncoming(id uint64, path string) error {
+	return channel.AcceptIncomingWithSync(id, path, channel.options.SyncPolicy)
+}
+
+/*
+AcceptIncomingWithSync accepts the pending file offer of the given id like
+AcceptIncoming, syncing the file to disk as the given policy says instead of as
+Options.SyncPolicy does.
+*/
+func (channel *Channel) AcceptIncomingWithSync(id uint64, path string, policy SyncPolicy) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	offer, exists := channel.incoming.take(id)
+	if !exists {
+		return ErrNoOffer
+	}
+	var err error
+	doErr := channel.do(func() {
+		err = channel.acceptIncoming(offer, path, policy)
+	})
+	if doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+/*
+RejectIncoming rejects the pending file offer of the given id.
+*/
+func (channel *Channel) RejectIncoming(id uint64) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	offer, exists := channel.incoming.take(id)
+	if !exists {
+		return ErrNoOffer
+	}
+	// let the other side know that we won't accept the file
+	return toxErr("FileControl", channel.tox.FileControl(offer.friend, offer.file, gotox.TOX_FILE_CONTROL_CANCEL))
+}
+
+/*
+AcceptConnection accepts the given address as a connection partner.
+*/
+func (channel *Channel) AcceptConnection(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if err := channel.checkCapacity(); err != nil {
+		return err
+	}
+	publicKey, err := address.PublicKey()
+	if err != nil {
+		return err
+	}
+	// ignore friendnumber
+	_, err = channel.tox.FriendAddNorequest(publicKey)
+	if err != nil {
+		return toxErr("FriendAddNorequest", err)
+	}
+	// accepting directly also settles any pending request
+	channel.requests.remove(address)
+	channel.notifyFriendAdded(address)
+	return nil
+}
+
+/*
+PendingRequests returns all received friend requests that have not been
+accepted or rejected yet, oldest first.
+*/
+func (channel *Channel) PendingRequests() []FriendRequest {
+	return channel.requests.list()
+}
+
+/*
+AcceptRequest accepts the pending friend request of the given address.
+*/
+func (channel *Channel) AcceptRequest(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if !channel.requests.has(address) {
+		return ErrNoRequest
+	}
+	// removes the request on success
+	return channel.AcceptConnection(address)
+}
+
+/*
+RejectRequest discards the pending friend request of the given address.
+*/
+func (channel *Channel) RejectRequest(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if !channel.requests.remove(address) {
+		return ErrNoRequest
+	}
+	return nil
+}
+
+/*
+RequestConnection sends a friend request to the given full Tox ID with the
+sending peer information as the message for bootstrapping.
+*/
+func (channel *Channel) RequestConnection(id, message string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if channel.isClosing() {
+		return ErrClosing
+	}
+	// fail early with a clear error on malformed IDs
+	if err := ValidateAddress(id); err != nil {
+		return err
+	}
+	if err := channel.checkCapacity(); err != nil {
+		return err
+	}
+	publicKey, err := hex.DecodeString(id)
+	if err != nil {
+		return err
+	}
+	// send non blocking friend request
+	_, err = channel.tox.FriendAdd(publicKey, message)
+	if err != nil {
+		return toxErr("FriendAdd", err)
+	}
+	// the ID contains nospam and checksum, the friend is known by the public key only
+	address := addressOfKey(publicKey)
+	channel.side.setFullID(address, strings.ToLower(id))
+	if channel.options.ResendRequests {
+		channel.resends.add(address, id, message, channel.options.ResendInterval)
+	}
+	channel.notifyFriendAdded(address)
+	return nil
+}
+
+/*
+RequestConnectionWithContext sends a friend request like RequestConnection
+unless the context has already expired.
+*/
+func (channel *Channel) RequestConnectionWithContext(ctx context.Context, id, message string) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return channel.RequestConnection(id, message)
+}
+
+/*
+CancelRequest stops re-sending the friend request to the given address and
+removes the friend that hasn't accepted it yet.
+*/
+func (channel *Channel) CancelRequest(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	if !channel.resends.remove(address) {
+		return ErrNoRequest
+	}
+	_, err := channel.RemoveConnection(address)
+	return err
+}
+
+/*
+RemoveConnection removes a friend from the friendlist, effectivly terminating
+the connection. All transfers to and from the friend are canceled first; the
+returned Removal summarizes what was aborted.
+*/
+func (channel *Channel) RemoveConnection(address Address) (Removal, error) {
+	if channel.isClosed() {
+		return Removal{}, ErrClosed
+	}
+	var removal Removal
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return removal, err
+	}
+	// the transfers and the connection status belong to the background thread
+	doErr := channel.do(func() {
+		removal, err = channel.removeConnection(address, num)
+	})
+	if doErr != nil {
+		return Removal{}, doErr
+	}
+	return removal, err
+}
+
+/*
+removeConnection cancels everything of the given friend and deletes it. Must be
+called from the background thread.
+*/
+func (channel *Channel) removeConnection(address Address, num uint32) (Removal, error) {
+	var removal Removal
+	// cancel active transfers
+	for fileNumber := range channel.transfers.ofFriend(num) {
+		channel.tox.FileControl(num, fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		channel.closeTransfer(fileNumber, StCanceled)
+		removal.Transfers++
+	}
+	channel.transfers.removeActive(address)
+	// drop queued transfers
+	if queue, exists := channel.transfers.removeQueue(address); exists {
+	drain:
+		for {
+			select {
+			case trans := <-queue:
+				trans.Close(StCanceled)
+				removal.Queued++
+			default:
+				break drain
+			}
+		}
+	}
+	// drop parked transfers
+	for _, trans := range channel.parked.remove(address) {
+		trans.Close(StCanceled)
+		removal.Parked++
+	}
+	// hang up any stream
+	channel.hangUpStream(address)
+	err := channel.tox.FriendDelete(num)
+	if err != nil {
+		return removal, toxErr("FriendDelete", err)
+	}
+	// friend numbers are reused, so forget the connection status
+	delete(channel.connStatus, num)
+	channel.resends.remove(address)
+	channel.notifyFriendListChanged()
+	return removal, nil
+}
+
+/*
+FriendCount returns the number of friends.
+*/
+func (channel *Channel) FriendCount() (int, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	friends, err := channel.tox.SelfGetFriendlist()
+	if err != nil {
+		return 0, toxErr("SelfGetFriendlist", err)
+	}
+	return len(friends), nil
+}
+
+/*
+FriendCapacity returns how many more friends can be added before the MaxFriends
+option is reached. Returns -1 if unlimited.
+*/
+func (channel *Channel) FriendCapacity() (int, error) {
+	if channel.isClosed() {
+		return 0, ErrClosed
+	}
+	if channel.options.MaxFriends <= 0 {
+		return -1, nil
+	}
+	count, err := channel.FriendCount()
+	if err != nil {
+		return 0, err
+	}
+	if count >= channel.options.MaxFriends {
+		return 0, nil
+	}
+	return channel.options.MaxFriends - count, nil
+}
+
+/*
+IsFriend returns whether the given address is a friend. Unlike the errors of
+other methods taking an address, an error here means that the lookup itself
+failed and not that the address is unknown.
+*/
+func (channel *Channel) IsFriend(address Address) (bool, error) {
+	if channel.isClosed() {
+		return false, ErrClosed
+	}
+	key, err := ParseAddress(string(address))
+	if err != nil {
+		return false, err
+	}
+	addresses, err := channel.FriendAddresses()
+	if err != nil {
+		return false, err
+	}
+	for _, friend := range addresses {
+		if friend == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/*
+IsAddressOnline checks whether the given address is currently reachable.
+*/
+func (channel *Channel) IsAddressOnline(address Address) (bool, error) {
+	if channel.isClosed() {
+		return false, ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return false, err
+	}
+	status, err := channel.tox.FriendGetConnectionStatus(num)
+	if err != nil {
+		return false, toxErr("FriendGetConnectionStatus", err)
+	}
+	return status != gotox.TOX_CONNECTION_NONE, nil
+}
+
+/*
+ConnectionTypeOf returns whether the given address is connected directly via
+UDP or relayed via TCP, which helps diagnosing slow transfers.
+*/
+func (channel *Channel) ConnectionTypeOf(address Address) (ConnectionType, error) {
+	if channel.isClosed() {
+		return CtNone, ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return CtNone, err
+	}
+	status, err := channel.tox.FriendGetConnectionStatus(num)
+	if err != nil {
+		return CtNone, toxErr("FriendGetConnectionStatus", err)
+	}
+	return connectionTypeOf(status), nil
+}
+
+/*
+FullAddressOf returns the complete Tox ID including nospam and checksum of the
+given address, if it was learned from a friend request. This allows re-inviting
+a removed friend. The full addresses are persisted with the ToxData.
+*/
+func (channel *Channel) FullAddressOf(address Address) (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
+	key, err := ParseAddress(string(address))
+	if err != nil {
+		return "", err
+	}
+	id, exists := channel.side.fullIDOf(key)
+	if !exists {
+		return "", ErrNoFullAddress
+	}
+	return id, nil
+}
+
+/*
+IsTyping returns whether the friend with the given address is currently typing.
+*/
+func (channel *Channel) IsTyping(address Address) (bool, error) {
+	if channel.isClosed() {
+		return false, ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return false, err
+	}
+	typing, err := channel.tox.FriendGetTyping(num)
+	return typing, toxErr("FriendGetTyping", err)
+}
+
+/*
+PeerStats returns the connection quality of the given address: reconnect
+frequency, average session length, and transfer failure rate. Useful to pick the
+healthiest peer for big transfers.
+*/
+func (channel *Channel) PeerStats(address Address) (PeerStats, error) {
+	if channel.isClosed() {
+		return PeerStats{}, ErrClosed
+	}
+	stats, exists := channel.quality.stats(address)
+	if !exists {
+		return PeerStats{}, ErrNoPeerStats
+	}
+	return stats, nil
+}
+
+/*
+NameOf the key associated to the given address.
+*/
+func (channel *Channel) NameOf(address Address) (string, error) {
+	if channel.isClosed() {
+		return "", ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return "", err
+	}
+	name, err := channel.tox.FriendGetName(num)
+	if err != nil {
+		return "", toxErr("FriendGetName", err)
+	}
+	return name, nil
+}
+
+/*
+StatusOf returns the user status the friend with the given address has set.
+*/
+func (channel *Channel) StatusOf(address Address) (UserStatus, error) {
+	if channel.isClosed() {
+		return UsNone, ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return UsNone, err
+	}
+	status, err := channel.tox.FriendGetStatus(num)
+	if err != nil {
+		return UsNone, toxErr("FriendGetStatus", err)
+	}
+	return userStatusOf(status), nil
+}
+
+/*
+Block the given address: friend requests, messages, and file transfers from it
+are silently dropped before any callback is called. The block list is persisted
+with the ToxData.
+*/
+func (channel *Channel) Block(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	// normalize so that full Tox IDs block the public key
+	address, err := ParseAddress(string(address))
+	if err != nil {
+		return err
+	}
+	channel.side.setBlocked(address, true)
+	return nil
+}
+
+/*
+Unblock the given address.
+*/
+func (channel *Channel) Unblock(address Address) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	address, err := ParseAddress(string(address))
+	if err != nil {
+		return err
+	}
+	channel.side.setBlocked(address, false)
+	return nil
+}
+
+/*
+Blocked returns all blocked addresses.
+*/
+func (channel *Channel) Blocked() []Address {
+	return channel.side.blocked()
+}
+
+/*
+LastSeen returns when the given address last changed its connection status or
+sent a message. If neither happened while the channel is running the last time
+Tox saw the friend online is returned.
+*/
+func (channel *Channel) LastSeen(address Address) (time.Time, error) {
+	if channel.isClosed() {
+		return time.Time{}, ErrClosed
+	}
+	num, err := channel.friendNumberOf(address)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if at, exists := channel.seen.last(address); exists {
+		return at, nil
+	}
+	last, err := channel.tox.FriendGetLastOnline(num)
+	return last, toxErr("FriendGetLastOnline", err)
+}
+
+/*
+IsOnline referes to the connection status of the channel. Always false while
+the channel was taken offline with GoOffline.
+*/
+func (channel *Channel) IsOnline() (bool, error) {
+	if channel.isClosed() {
+		return false, ErrClosed
+	}
+	if channel.isPaused() {
+		return false, nil
+	}
+	status, err := channel.tox.SelfGetConnectionStatus()
+	if err != nil {
+		return false, toxErr("SelfGetConnectionStatus", err)
+	}
+	if status != gotox.TOX_CONNECTION_NONE {
+		return true, nil
+	}
+	return false, nil
+}
+
+/*
+WaitUntilOnline blocks until the channel is connected to the Tox network or the
+context expires. Returns ErrClosed if the channel is closed meanwhile.
+*/
+func (channel *Channel) WaitUntilOnline(ctx context.Context) error {
+	if channel.isClosed() {
+		return ErrClosed
+	}
+	// subscribe first so that coming online in between can't be missed
+	events, unsubscribe := channel.Subscribe(FilterKinds(EvSelfOnline))
+	defer unsubscribe()
+	online, err := channel.IsOnline()
+	if err != nil || online {
+		return err
+	}
+	select {
+	case _, ok := <-events:
+		if !ok {
+			return ErrClosed
+		}
+		return nil
+	case <-channel.stop:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Events returns a channel on which typed events are sent, as an alternative to
+the Callbacks for select based consumers. Events are only collected once this
+has been called and are dropped if the consumer doesn't keep up. The channel is
+never closed.
+*/
+func (channel *Channel) Events() <-chan Event {
+	return channel.events.mainQueue()
+}
+
+/*
+Subscribe returns a channel on which the events selected by the filter are sent,
+so that several parts of an application can observe the channel independently.
+Each subscriber has its own buffer and drops events if it doesn't keep up. Call
+the returned function to unsubscribe, which closes the channel.
+*/
+func (channel *Channel) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	sub := channel.events.subscribe(filter)
+	return sub.queue, func() { channel.events.unsubscribe(sub) }
+}
+
+/*
+SetCallbacks replaces the callbacks of the channel. Events that are already
+being delivered may still reach the old callbacks. Nil restores the defaults
+of Funcs. Single callbacks can be registered with the On...Func methods instead,
+which replace callbacks that aren't Funcs.
+*/
+func (channel *Channel) SetCallbacks(callbacks Callbacks) {
+	if callbacks == nil {
+		callbacks = &Funcs{}
+	}
+	channel.callbackMut.Lock()
+	defer channel.callbackMut.Unlock()
+	channel.callbacks = callbacks
+}
+
+/*OnFriendRequestFunc registers f for OnFriendRequest. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnFriendRequestFunc(f func(address Address, message string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.FriendRequest = f })
+}
+
+/*OnMessageFunc registers f for OnMessage. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnMessageFunc(f func(address Address, message string, kind MessageType)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.Message = f })
+}
+
+/*OnAllowFileFunc registers f for OnAllowFile. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnAllowFileFunc(f func(address Address, name string) (bool, string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.AllowFile = f })
+}
+
+/*OnFileReceivedFunc registers f for OnFileReceived. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnFileReceivedFunc(f func(address Address, path, name string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.FileReceived = f })
+}
+
+/*OnFileCanceledFunc registers f for OnFileCanceled. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnFileCanceledFunc(f func(address Address, path string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.FileCanceled = f })
+}
+
+/*OnConnectedFunc registers f for OnConnected. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnConnectedFunc(f func(address Address, kind ConnectionType)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.Connected = f })
+}
+
+/*OnFriendAddedFunc registers f for OnFriendAdded. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnFriendAddedFunc(f func(address Address)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.FriendAdded = f })
+}
+
+/*OnFriendListChangedFunc registers f for OnFriendListChanged. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnFriendListChangedFunc(f func()) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.FriendListChanged = f })
+}
+
+/*OnStatusChangeFunc registers f for OnStatusChange. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnStatusChangeFunc(f func(address Address, status UserStatus)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.StatusChange = f })
+}
+
+/*OnNameChangeFunc registers f for OnNameChange. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnNameChangeFunc(f func(address Address, name string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.NameChange = f })
+}
+
+/*OnStatusMessageChangeFunc registers f for OnStatusMessageChange. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnStatusMessageChangeFunc(f func(address Address, message string)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.StatusMessageChange = f })
+}
+
+/*OnConnectionTypeChangedFunc registers f for OnConnectionTypeChanged. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnConnectionTypeChangedFunc(f func(address Address, kind ConnectionType)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.ConnectionTypeChanged = f })
+}
+
+/*OnNetworkStatusFunc registers f for OnNetworkStatus. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnNetworkStatusFunc(f func(online bool, nodes []Node)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.NetworkStatus = f })
+}
+
+/*OnSelfConnectionStatusFunc registers f for OnSelfConnectionStatus. Nil restores the wrapped Callbacks or the default of Funcs.*/
+func (channel *Channel) OnSelfConnectionStatusFunc(f func(kind ConnectionType)) {
+	channel.updateFuncs(func(funcs *Funcs) { funcs.SelfConnectionStatus = f })
+}
+
+/*
+SetLogLevel changes the level of log output at runtime, for example to LvDebug
+to see every chunk while debugging a stuck transfer.
+*/
+func (channel *Channel) SetLogLevel(level LogLevel) {
+	channel.logger.setLevel(level)
+}
+
+/*
+Stats returns a snapshot of the counters of the channel.
+*/
+func (channel *Channel) Stats() Stats {
+	stats := channel.stats()
+	// the transfers belong to the background thread
+	channel.do(func() {
+		stats.TransfersActive = channel.transfers.count()
+	})
+	return stats
+}
+
+/*
+stats returns the counters of the channel without those owned by the background
+thread.
+*/
+func (channel *Channel) stats() Stats {
+	stats := channel.counters.snapshot()
+	stats.Connection = channel.connection()
+	stats.Uptime = time.Since(channel.created)
+	stats.ChunkService = channel.timings.chunkService.snapshot()
+	stats.DiskRead = channel.timings.diskRead.snapshot()
+	stats.DiskWrite = channel.timings.diskWrite.snapshot()
+	stats.ToxSend = channel.timings.toxSend.snapshot()
+	stats.Throughput = channel.timings.throughput.snapshot()
+	if online, err := channel.OnlineAddresses(); err == nil {
+		stats.FriendsOnline = len(online)
+	}
+	if funcs, ok := channel.handler().(*Funcs); ok {
+		stats.DroppedEvents += funcs.Dropped()
+	}
+	return stats
+}
+
+/*
+ActiveTransfers returns a map of file names and associated percentage done. By
+polling it regularly this can be used to offer feedback on long transfers.
+*/
+func (channel *Channel) ActiveTransfers() map[string]int {
+	list := make(map[string]int)
+	channel.do(func() {
+		for _, transfer := range channel.transfers.all() {
+			list[transfer.file.Name()] = transfer.Percentage()
+		}
+	})
 	return list
 }
@@ -0,0 +1,116 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+minBurst is the smallest burst a bucket allows so that a single chunk or message
+always fits.
+*/
+const minBurst = 4096
+
+/*
+chunkRequest is a chunk request by Tox that is waiting to be sent.
+*/
+type chunkRequest struct {
+	friend     uint32
+	fileNumber uint32
+	position   uint64
+	length     uint64
+	requested  time.Time // when Tox asked for the chunk
+}
+
+/*
+bucket is a token bucket counting bytes that is shared by all outgoing traffic.
+Chunks only take tokens if enough are available while messages have priority and
+may go into debt, which in turn delays the chunks.
+*/
+type bucket struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second, zero means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+/*
+setRate of the bucket in bytes per second. Zero disables rate limiting.
+*/
+func (b *bucket) setRate(bytesPerSecond uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = float64(bytesPerSecond)
+	b.burst = b.rate
+	if b.burst < minBurst {
+		b.burst = minBurst
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+}
+
+/*
+refill adds the tokens accumulated since the last call. Must be called with the
+mutex held.
+*/
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+/*
+take removes the given amount of tokens if enough are available. Used for bulk
+traffic.
+*/
+func (b *bucket) take(amount uint64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill()
+	if b.tokens < float64(amount) {
+		return false
+	}
+	b.tokens -= float64(amount)
+	return true
+}
+
+/*
+refund returns tokens that were taken but not used because sending failed.
+*/
+func (b *bucket) refund(amount uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate == 0 {
+		return
+	}
+	b.refill()
+	b.tokens += float64(amount)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+/*
+force removes the given amount of tokens with priority, allowing the bucket to
+go into debt of up to one burst. Used for messages.
+*/
+func (b *bucket) force(amount uint64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill()
+	if b.tokens-float64(amount) < -b.burst {
+		return false
+	}
+	b.tokens -= float64(amount)
+	return true
+}
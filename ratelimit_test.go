@@ -0,0 +1,45 @@
+package channel
+
+import "testing"
+
+/*
+TestBucket checks taking, forcing and refunding tokens in order. The rate is so
+low that refilling is negligible.
+*/
+func TestBucket(t *testing.T) {
+	var b bucket
+	b.setRate(1)
+	tests := []struct {
+		name   string
+		op     func(amount uint64) bool
+		amount uint64
+		want   bool
+	}{
+		{"take within burst", b.take, minBurst - 100, true},
+		{"take beyond tokens", b.take, 200, false},
+		{"take rest", b.take, 100, true},
+		{"refund capped at burst", func(amount uint64) bool { b.refund(amount); return true }, 2 * minBurst, true},
+		{"take whole burst", b.take, minBurst, true},
+		{"force into debt", b.force, minBurst, true},
+		{"force beyond debt", b.force, 1, false},
+		{"take in debt", b.take, 1, false},
+	}
+	for _, test := range tests {
+		if got := test.op(test.amount); got != test.want {
+			t.Fatalf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+/*
+TestBucketUnlimited checks that a zero rate never limits.
+*/
+func TestBucketUnlimited(t *testing.T) {
+	var b bucket
+	b.setRate(0)
+	for i := 0; i < 3; i++ {
+		if !b.take(1<<30) || !b.force(1<<30) {
+			t.Fatal("unlimited bucket limited")
+		}
+	}
+}
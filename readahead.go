@@ -0,0 +1,127 @@
+package channel
+
+import (
+	"os"
+	"sync"
+)
+
+/*
+readBlockSize is the size of the blocks a readAhead reads at once.
+*/
+const readBlockSize = 64 * 1024
+
+/*
+readAhead reads a sent file ahead of the chunk requests in the background, so
+that chunks are served from memory instead of waiting for the disk.
+*/
+type readAhead struct {
+	mutex  sync.Mutex
+	file   *os.File
+	size   uint64
+	window uint64            // bytes to keep read ahead of the last request
+	blocks map[uint64][]byte // read blocks by position
+	next   uint64            // position of the next block to read
+	wanted uint64            // position of the last request
+	wake   chan bool         // wakes the reader once a request moved the window
+	done   chan bool         // stops the reader
+}
+
+/*
+buildReadAhead starts reading the given file ahead by the given number of chunks.
+*/
+func buildReadAhead(file *os.File, size uint64, chunks int, r *routines) *readAhead {
+	window := uint64(chunks) * toxChunkSize
+	if window < readBlockSize {
+		window = readBlockSize
+	}
+	ahead := &readAhead{
+		file:   file,
+		size:   size,
+		window: window,
+		blocks: make(map[uint64][]byte),
+		wake:   make(chan bool, 1),
+		done:   make(chan bool)}
+	r.start(subsystemReadAhead, ahead.run)
+	return ahead
+}
+
+/*
+run reads blocks until the window is full, then waits for the next request.
+*/
+func (r *readAhead) run() {
+	for {
+		r.mutex.Lock()
+		position := r.next
+		full := position >= r.size || position >= r.wanted+r.window
+		r.mutex.Unlock()
+		if full {
+			select {
+			case <-r.wake:
+				continue
+			case <-r.done:
+				return
+			}
+		}
+		length := r.size - position
+		if length > readBlockSize {
+			length = readBlockSize
+		}
+		block := make([]byte, length)
+		_, err := r.file.ReadAt(block, int64(position))
+		if err != nil {
+			// the chunks are read directly instead
+			return
+		}
+		r.mutex.Lock()
+		// a jump may have moved the reader elsewhere in the meantime
+		if r.next == position {
+			r.blocks[position] = block
+			r.next = position + length
+		}
+		r.mutex.Unlock()
+	}
+}
+
+/*
+read copies the chunk at the given position into data if it has been read
+already, returning whether it was. Blocks before the position are dropped as
+chunks are requested in order.
+*/
+func (r *readAhead) read(position uint64, data []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.wanted = position
+	for start := range r.blocks {
+		if start+uint64(len(r.blocks[start])) <= position {
+			delete(r.blocks, start)
+		}
+	}
+	first := position - position%readBlockSize
+	// start over at the position unless its block is read or about to be
+	if _, exists := r.blocks[first]; !exists && first != r.next {
+		r.blocks = make(map[uint64][]byte)
+		r.next = first
+	}
+	select {
+	case r.wake <- true:
+	default:
+	}
+	copied := 0
+	for copied < len(data) {
+		at := position + uint64(copied)
+		start := at - at%readBlockSize
+		block, exists := r.blocks[start]
+		if !exists {
+			return false
+		}
+		copied += copy(data[copied:], block[at-start:])
+	}
+	return true
+}
+
+/*
+stop the reader.
+*/
+func (r *readAhead) stop() {
+	close(r.done)
+}
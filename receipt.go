@@ -0,0 +1,10 @@
+package channel
+
+/*
+receipt identifies a sent message for which a read receipt is expected. Tox
+message IDs are only unique per friend, so both are required.
+*/
+type receipt struct {
+	friend  uint32
+	message uint32
+}
@@ -0,0 +1,100 @@
+package channel
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+maxPendingRequests is the number of friend requests that are buffered. If more
+arrive the oldest is dropped.
+*/
+const maxPendingRequests = 128
+
+/*
+FriendRequest is a received friend request that has not been accepted or
+rejected yet.
+*/
+type FriendRequest struct {
+	Address  Address
+	Message  string
+	Received time.Time
+}
+
+/*
+pendingRequests buffers received friend requests by address.
+*/
+type pendingRequests struct {
+	mutex    sync.Mutex
+	requests map[Address]FriendRequest
+}
+
+/*
+add a friend request, replacing an older one from the same address.
+*/
+func (p *pendingRequests) add(request FriendRequest) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.requests == nil {
+		p.requests = make(map[Address]FriendRequest)
+	}
+	p.requests[request.Address] = request
+	if len(p.requests) <= maxPendingRequests {
+		return
+	}
+	// drop the oldest
+	var oldest FriendRequest
+	for _, request := range p.requests {
+		if oldest.Address == "" || request.Received.Before(oldest.Received) {
+			oldest = request
+		}
+	}
+	delete(p.requests, oldest.Address)
+}
+
+/*
+has returns whether a request of the given address is pending.
+*/
+func (p *pendingRequests) has(address Address) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, exists := p.requests[address]
+	return exists
+}
+
+/*
+remove the request of the given address, returning whether it existed.
+*/
+func (p *pendingRequests) remove(address Address) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, exists := p.requests[address]
+	delete(p.requests, address)
+	return exists
+}
+
+/*
+list all pending requests, oldest first.
+*/
+func (p *pendingRequests) list() []FriendRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var list []FriendRequest
+	for _, request := range p.requests {
+		list = append(list, request)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Received.Before(list[j].Received)
+	})
+	return list
+}
+
+/*
+clear all pending requests.
+*/
+func (p *pendingRequests) clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests = nil
+}
@@ -0,0 +1,88 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+maxResendInterval caps the backoff between friend request re-sends.
+*/
+const maxResendInterval = 6 * time.Hour
+
+/*
+resend is a friend request that is re-sent until it is accepted.
+*/
+type resend struct {
+	id       string // full Tox ID the request is sent to
+	message  string
+	interval time.Duration
+	next     time.Time
+}
+
+/*
+resends tracks all friend requests that are re-sent by address.
+*/
+type resends struct {
+	mutex    sync.Mutex
+	requests map[Address]*resend
+}
+
+/*
+add a request to re-send, starting with the given interval.
+*/
+func (r *resends) add(address Address, id, message string, interval time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.requests == nil {
+		r.requests = make(map[Address]*resend)
+	}
+	r.requests[address] = &resend{
+		id:       id,
+		message:  message,
+		interval: interval,
+		next:     time.Now().Add(interval)}
+}
+
+/*
+remove the request of the given address, returning whether it existed.
+*/
+func (r *resends) remove(address Address) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, exists := r.requests[address]
+	delete(r.requests, address)
+	return exists
+}
+
+/*
+clear all requests.
+*/
+func (r *resends) clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = nil
+}
+
+/*
+due returns all requests by address that must be re-sent now and schedules
+their next re-send with doubled interval.
+*/
+func (r *resends) due() map[Address]resend {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	due := make(map[Address]resend)
+	now := time.Now()
+	for address, request := range r.requests {
+		if now.Before(request.next) {
+			continue
+		}
+		due[address] = *request
+		request.interval *= 2
+		if request.interval > maxResendInterval {
+			request.interval = maxResendInterval
+		}
+		request.next = now.Add(request.interval)
+	}
+	return due
+}
@@ -0,0 +1,47 @@
+package channel
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestResendBackoff checks that requests are only due once their interval has
+passed and that the interval doubles up to maxResendInterval.
+*/
+func TestResendBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		due      bool
+		next     time.Duration
+	}{
+		{"not yet due", time.Hour, false, time.Hour},
+		{"due doubles", time.Minute, true, 2 * time.Minute},
+		{"due capped", maxResendInterval, true, maxResendInterval},
+	}
+	for _, test := range tests {
+		var r resends
+		r.add("peer", "id", "hello", test.interval)
+		if test.due {
+			// move the request into the past so that it is due
+			r.requests["peer"].next = time.Now().Add(-time.Second)
+		}
+		due := r.due()
+		if _, exists := due["peer"]; exists != test.due {
+			t.Errorf("%s: due %v, want %v", test.name, exists, test.due)
+		}
+		if got := r.requests["peer"].interval; got != test.next {
+			t.Errorf("%s: interval %v, want %v", test.name, got, test.next)
+		}
+	}
+	// a removed request is never due
+	var r resends
+	r.add("peer", "id", "hello", 0)
+	if !r.remove("peer") || r.remove("peer") {
+		t.Error("remove must report whether the request existed")
+	}
+	if len(r.due()) != 0 {
+		t.Error("removed request is still due")
+	}
+}
@@ -0,0 +1,117 @@
+package channel
+
+import (
+	"time"
+
+	"github.com/codedust/go-tox"
+)
+
+/*
+restart is a request to the background thread to replace the Tox instance.
+*/
+type restart struct {
+	toxdata []byte     // savedata for the new instance, nil for the current one
+	side    *sidecar   // channel data of a new identity, nil to keep the identity
+	done    chan error // receives the result
+}
+
+/*
+restartTox replaces the Tox instance with a new one created from the given
+savedata, or from the current savedata if nil. Everything bound to the old
+instance is reset as if all friends went offline. If a sidecar is given the
+identity changes, so everything bound to the old friends is dropped too. On
+error the old instance is kept.
+*/
+func (channel *Channel) restartTox(toxdata []byte, side *sidecar) error {
+	if channel.custom {
+		return ErrNotSupported
+	}
+	var err error
+	if toxdata == nil {
+		toxdata, err = channel.tox.GetSavedata()
+		if err != nil {
+			return toxErr("GetSavedata", err)
+		}
+	}
+	tox, err := gotox.New(channel.options.toxOptions(toxdata))
+	if err != nil {
+		return toxErr("New", err)
+	}
+	channel.dropConnections()
+	if side != nil {
+		channel.forgetFriends()
+		channel.side.replace(side)
+	}
+	// public methods may be using the old instance right now
+	channel.tox.swap(tox)
+	channel.registerCallbacks()
+	err = channel.tox.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
+	if err != nil {
+		channel.logger.Warn("Restart: setting status failed:", err)
+	}
+	// we start out offline again
+	channel.selfConnectionChanged(CtNone)
+	channel.bootStarted = time.Time{}
+	channel.bootstrap()
+	channel.logger.Info("Restarted Tox.")
+	return nil
+}
+
+/*
+dropConnections fails all transfers and treats all friends as gone offline, as
+the Tox instance they belong to is going away.
+*/
+func (channel *Channel) dropConnections() {
+	for fileNumber, tran := range channel.transfers.all() {
+		address, _ := channel.addressOf(tran.friend)
+		channel.closeTransfer(fileNumber, StFailed)
+		path := tran.path
+		channel.dispatch(address, func() { channel.handler().OnFileCanceled(address, path) })
+	}
+	channel.transfers.clearActive()
+	channel.incoming.clear()
+	channel.deferred = nil
+	for friendnumber, status := range channel.connStatus {
+		if status == gotox.TOX_CONNECTION_NONE {
+			continue
+		}
+		address, err := channel.addressOf(friendnumber)
+		if err != nil {
+			continue
+		}
+		channel.quality.disconnected(address)
+		channel.hangUpStream(address)
+		channel.emit(Event{Kind: EvFriendOffline, Address: address})
+	}
+	channel.connStatus = make(map[uint32]gotox.ToxConnection)
+}
+
+/*
+forgetFriends cancels and drops everything queued for the friends of the old
+identity, as their friend numbers mean nothing to the new one.
+*/
+func (channel *Channel) forgetFriends() {
+	for _, queue := range channel.transfers.clearQueues() {
+		for len(queue) > 0 {
+			(<-queue).Close(StCanceled)
+		}
+	}
+	for _, tran := range channel.parked.clear() {
+		tran.Close(StCanceled)
+	}
+	channel.outbox.clear()
+	channel.requests.clear()
+	channel.resends.clear()
+	channel.streamMut.Lock()
+	var addresses []Address
+	for address := range channel.streams {
+		addresses = append(addresses, address)
+	}
+	channel.streamMut.Unlock()
+	for _, address := range addresses {
+		channel.hangUpStream(address)
+	}
+	channel.receiptMut.Lock()
+	channel.receipts = make(map[receipt]chan bool)
+	channel.receiptMut.Unlock()
+}
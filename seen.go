@@ -0,0 +1,37 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+seen tracks when each address was last seen, meaning its connection status
+changed or it sent a message.
+*/
+type seen struct {
+	mutex sync.Mutex
+	times map[Address]time.Time
+}
+
+/*
+touch marks the given address as seen now.
+*/
+func (s *seen) touch(address Address) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.times == nil {
+		s.times = make(map[Address]time.Time)
+	}
+	s.times[address] = time.Now()
+}
+
+/*
+last returns when the given address was last seen.
+*/
+func (s *seen) last(address Address) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	at, exists := s.times[address]
+	return at, exists
+}
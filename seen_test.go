@@ -0,0 +1,30 @@
+package channel
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestSeen checks that only touched addresses are seen, each at its latest touch.
+*/
+func TestSeen(t *testing.T) {
+	var s seen
+	if _, exists := s.last("peer"); exists {
+		t.Fatal("address seen before it was touched")
+	}
+	before := time.Now()
+	s.touch("peer")
+	first, exists := s.last("peer")
+	if !exists || first.Before(before) {
+		t.Fatalf("first touch at %v, exists %v", first, exists)
+	}
+	time.Sleep(time.Millisecond)
+	s.touch("peer")
+	if second, _ := s.last("peer"); !second.After(first) {
+		t.Errorf("second touch at %v not after first at %v", second, first)
+	}
+	if _, exists := s.last("other"); exists {
+		t.Error("untouched address seen")
+	}
+}
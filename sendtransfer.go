@@ -1,10 +1,14 @@
 package channel
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 type sendTransfer struct {
-	started    bool
+	started    int32 // set once data is moving, accessed atomically
 	began      time.Time
+	timeout    time.Duration // after which the send is thrown away if it hasn't started
 	fileNumber uint32
 }
 
@@ -12,10 +16,10 @@ type sendTransfer struct {
 buildSendTransfer creates a new transfer with primed values. Note that the timeout
 runs from the moment this method is called for isStale.
 */
-func buildSendTransfer(fileNumber uint32) *sendTransfer {
+func buildSendTransfer(fileNumber uint32, timeout time.Duration) *sendTransfer {
 	return &sendTransfer{
-		started:    false,
 		began:      time.Now(),
+		timeout:    timeout,
 		fileNumber: fileNumber}
 }
 
@@ -24,5 +28,19 @@ isStale returns true if the timeout for starting the send transfer has been
 reached without the transfer actually beginning.
 */
 func (st *sendTransfer) isStale() bool {
-	return time.Since(st.began) > sendTimeout && !st.started
+	return time.Since(st.began) > st.timeout && !st.hasStarted()
+}
+
+/*
+start marks the send as started so that it no longer times out.
+*/
+func (st *sendTransfer) start() {
+	atomic.StoreInt32(&st.started, 1)
+}
+
+/*
+hasStarted returns whether data is moving.
+*/
+func (st *sendTransfer) hasStarted() bool {
+	return atomic.LoadInt32(&st.started) == 1
 }
@@ -0,0 +1,232 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+/*
+sidecarMagic marks ToxData that contains channel data in addition to the Tox
+savedata. Tox savedata itself always starts with four zero bytes, so the two can
+not be confused.
+*/
+var sidecarMagic = []byte("TZCH")
+
+/*
+sidecarVersion is the current version of the container format.
+*/
+const sidecarVersion byte = 1
+
+/*
+sidecar holds the channel data that is persisted together with the Tox savedata.
+*/
+type sidecar struct {
+	mutex   sync.Mutex
+	Aliases map[Address]string            `json:"aliases,omitempty"`
+	Blocked map[Address]bool              `json:"blocked,omitempty"`
+	FullIDs map[Address]string            `json:"fullids,omitempty"`
+	Meta    map[Address]map[string]string `json:"meta,omitempty"`
+	Nodes   map[string]*nodeHealth        `json:"nodes,omitempty"`
+}
+
+/*
+buildSidecar creates an empty sidecar.
+*/
+func buildSidecar() *sidecar {
+	return &sidecar{
+		Aliases: make(map[Address]string),
+		Blocked: make(map[Address]bool),
+		FullIDs: make(map[Address]string),
+		Meta:    make(map[Address]map[string]string),
+		Nodes:   make(map[string]*nodeHealth)}
+}
+
+/*
+setAlias for the given address. An empty alias removes it.
+*/
+func (s *sidecar) setAlias(address Address, alias string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if alias == "" {
+		delete(s.Aliases, address)
+		return
+	}
+	s.Aliases[address] = alias
+}
+
+/*
+aliasOf the given address.
+*/
+func (s *sidecar) aliasOf(address Address) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	alias, exists := s.Aliases[address]
+	return alias, exists
+}
+
+/*
+setFullID remembers the full Tox ID of the given address.
+*/
+func (s *sidecar) setFullID(address Address, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.FullIDs[address] = id
+}
+
+/*
+fullIDOf the given address.
+*/
+func (s *sidecar) fullIDOf(address Address) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, exists := s.FullIDs[address]
+	return id, exists
+}
+
+/*
+setMeta sets a metadata value for the given address. An empty value removes it.
+*/
+func (s *sidecar) setMeta(address Address, key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	meta, exists := s.Meta[address]
+	if !exists {
+		if value == "" {
+			return
+		}
+		meta = make(map[string]string)
+		s.Meta[address] = meta
+	}
+	if value == "" {
+		delete(meta, key)
+		if len(meta) == 0 {
+			delete(s.Meta, address)
+		}
+		return
+	}
+	meta[key] = value
+}
+
+/*
+metaOf returns the metadata value of the given address and key.
+*/
+func (s *sidecar) metaOf(address Address, key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, exists := s.Meta[address][key]
+	return value, exists
+}
+
+/*
+setBlocked blocks or unblocks the given address.
+*/
+func (s *sidecar) setBlocked(address Address, blocked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if blocked {
+		s.Blocked[address] = true
+	} else {
+		delete(s.Blocked, address)
+	}
+}
+
+/*
+isBlocked returns whether the given address is blocked.
+*/
+func (s *sidecar) isBlocked(address Address) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Blocked[address]
+}
+
+/*
+blocked returns all blocked addresses, sorted.
+*/
+func (s *sidecar) blocked() []Address {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var addresses []Address
+	for address := range s.Blocked {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	return addresses
+}
+
+/*
+replace the contents of the sidecar with those of the given one.
+*/
+func (s *sidecar) replace(other *sidecar) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Aliases = other.Aliases
+	s.Blocked = other.Blocked
+	s.FullIDs = other.FullIDs
+	s.Meta = other.Meta
+	s.Nodes = other.Nodes
+}
+
+/*
+pack the Tox savedata and the sidecar into a single blob: magic, version, length
+of the savedata, savedata, JSON of the sidecar.
+*/
+func (s *sidecar) pack(toxdata []byte) ([]byte, error) {
+	s.mutex.Lock()
+	side, err := json.Marshal(s)
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	buffer.Write(sidecarMagic)
+	buffer.WriteByte(sidecarVersion)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(toxdata)))
+	buffer.Write(length)
+	buffer.Write(toxdata)
+	buffer.Write(side)
+	return buffer.Bytes(), nil
+}
+
+/*
+unpackSidecar splits the given data into the Tox savedata and the sidecar. Plain
+Tox savedata is returned as is with an empty sidecar.
+*/
+func unpackSidecar(data []byte) ([]byte, *sidecar, error) {
+	side := buildSidecar()
+	if !bytes.HasPrefix(data, sidecarMagic) {
+		return data, side, nil
+	}
+	header := len(sidecarMagic) + 1 + 4
+	if len(data) < header || data[len(sidecarMagic)] != sidecarVersion {
+		return nil, nil, ErrCorruptData
+	}
+	length := int(binary.BigEndian.Uint32(data[len(sidecarMagic)+1 : header]))
+	if len(data) < header+length {
+		return nil, nil, ErrCorruptData
+	}
+	toxdata := data[header : header+length]
+	err := json.Unmarshal(data[header+length:], side)
+	if err != nil {
+		return nil, nil, err
+	}
+	if side.Aliases == nil {
+		side.Aliases = make(map[Address]string)
+	}
+	if side.Blocked == nil {
+		side.Blocked = make(map[Address]bool)
+	}
+	if side.FullIDs == nil {
+		side.FullIDs = make(map[Address]string)
+	}
+	if side.Meta == nil {
+		side.Meta = make(map[Address]map[string]string)
+	}
+	if side.Nodes == nil {
+		side.Nodes = make(map[string]*nodeHealth)
+	}
+	return toxdata, side, nil
+}
@@ -0,0 +1,86 @@
+package channel
+
+import (
+	"bytes"
+	"testing"
+)
+
+/*
+TestSidecarRoundTrip checks that packed channel data unpacks to the same Tox
+savedata and sidecar.
+*/
+func TestSidecarRoundTrip(t *testing.T) {
+	side := buildSidecar()
+	side.setAlias("peer", "alias")
+	side.setBlocked("blocked", true)
+	side.setFullID("peer", "full")
+	side.setMeta("peer", "key", "value")
+	side.nodeSucceeded("node", 0)
+	toxdata := []byte{0, 0, 0, 0, 1, 2, 3}
+	packed, err := side.pack(toxdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, unpacked, err := unpackSidecar(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, toxdata) {
+		t.Errorf("savedata %v, want %v", data, toxdata)
+	}
+	if alias, _ := unpacked.aliasOf("peer"); alias != "alias" {
+		t.Errorf("alias %q, want %q", alias, "alias")
+	}
+	if !unpacked.isBlocked("blocked") {
+		t.Error("blocked address lost")
+	}
+	if id, _ := unpacked.fullIDOf("peer"); id != "full" {
+		t.Errorf("full ID %q, want %q", id, "full")
+	}
+	if value, _ := unpacked.metaOf("peer", "key"); value != "value" {
+		t.Errorf("meta %q, want %q", value, "value")
+	}
+	if health := unpacked.Nodes["node"]; health == nil || health.Successes != 1 {
+		t.Errorf("node health %v lost", health)
+	}
+}
+
+/*
+TestUnpackSidecar checks that plain savedata passes through and that corrupt
+channel data is rejected.
+*/
+func TestUnpackSidecar(t *testing.T) {
+	packed, err := buildSidecar().pack([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongVersion := append([]byte(nil), packed...)
+	wrongVersion[len(sidecarMagic)] = sidecarVersion + 1
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		corrupt bool
+	}{
+		{"plain savedata", []byte{0, 0, 0, 0, 5}, false, false},
+		{"empty", nil, false, false},
+		{"packed", packed, false, false},
+		{"header only", packed[:len(sidecarMagic)+2], true, true},
+		{"wrong version", wrongVersion, true, true},
+		{"savedata cut off", packed[:len(sidecarMagic)+1+4+2], true, true},
+		{"sidecar cut off", packed[:len(packed)-1], true, false},
+	}
+	for _, test := range tests {
+		_, side, err := unpackSidecar(test.data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.corrupt && err != ErrCorruptData {
+			t.Errorf("%s: error %v, want %v", test.name, err, ErrCorruptData)
+		}
+		if err == nil && (side == nil || side.Aliases == nil || side.Nodes == nil) {
+			t.Errorf("%s: sidecar not initialized", test.name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package channel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+Stats is a snapshot of the counters of a channel.
+*/
+type Stats struct {
+	/*ChunkRetries counts chunks that failed to send with a transient error and
+	were retried.*/
+	ChunkRetries uint64
+	/*ChunkFailures counts chunks that failed to send with a fatal error, failing
+	their transfer.*/
+	ChunkFailures uint64
+	/*DroppedEvents counts friend requests and messages that were dropped because
+	no callback handled them, and events and callbacks dropped because their
+	consumer didn't keep up.*/
+	DroppedEvents uint64
+	/*BootstrapAttempts counts nodes bootstrapped to.*/
+	BootstrapAttempts uint64
+	/*BootstrapSuccesses counts nodes that accepted the bootstrap request.*/
+	BootstrapSuccesses uint64
+	/*Reconnects counts how often the channel came back online after it had
+	been online before.*/
+	Reconnects uint64
+	/*Uptime is how long the channel has been running.*/
+	Uptime time.Duration
+	/*TimeToFirstConnection is how long the channel took to come online for the
+	first time after it was created. Zero until then.*/
+	TimeToFirstConnection time.Duration
+	/*MessagesSent counts messages handed to Tox.*/
+	MessagesSent uint64
+	/*MessagesReceived counts messages received from friends.*/
+	MessagesReceived uint64
+	/*TransfersActive is the number of file transfers currently running.*/
+	TransfersActive int
+	/*TransfersCompleted counts file transfers that finished successfully.*/
+	TransfersCompleted uint64
+	/*TransfersFailed counts file transfers that failed.*/
+	TransfersFailed uint64
+	/*TransfersTimedOut counts file transfers that timed out.*/
+	TransfersTimedOut uint64
+	/*TransfersCanceled counts file transfers that were canceled by either side.*/
+	TransfersCanceled uint64
+	/*BytesSent counts file data sent.*/
+	BytesSent uint64
+	/*BytesReceived counts file data received.*/
+	BytesReceived uint64
+	/*FriendsOnline is the number of friends currently online.*/
+	FriendsOnline int
+	/*ChunkService is the distribution of seconds from Tox requesting a chunk
+	until it was sent, including waiting for the rate limit.*/
+	ChunkService Histogram
+	/*DiskRead is the distribution of seconds spent reading chunks to send.*/
+	DiskRead Histogram
+	/*DiskWrite is the distribution of seconds spent writing received chunks.*/
+	DiskWrite Histogram
+	/*ToxSend is the distribution of seconds spent handing chunks to Tox.*/
+	ToxSend Histogram
+	/*Throughput is the distribution of bytes per second of successful
+	transfers, in either direction.*/
+	Throughput Histogram
+	/*Connection is the current connection of the channel to the Tox network.
+	Tox doesn't expose how close it is within the DHT, but CtTCP means it only
+	reaches the network through relays.*/
+	Connection ConnectionType
+}
+
+/*
+counters are the live values behind Stats. All fields are accessed atomically.
+*/
+type counters struct {
+	chunkRetries       uint64
+	chunkFailures      uint64
+	droppedEvents      uint64
+	bootAttempts       uint64
+	bootSuccesses      uint64
+	firstOnline        int64 // nanoseconds from creation until first online, zero until then
+	messagesSent       uint64
+	messagesReceived   uint64
+	transfersCompleted uint64
+	transfersFailed    uint64
+	transfersTimedOut  uint64
+	transfersCanceled  uint64
+	reconnects         uint64
+	bytesSent          uint64
+	bytesReceived      uint64
+}
+
+/*
+inc atomically increments the given counter.
+*/
+func inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+/*
+snapshot of the counters.
+*/
+func (c *counters) snapshot() Stats {
+	return Stats{
+		ChunkRetries:          atomic.LoadUint64(&c.chunkRetries),
+		ChunkFailures:         atomic.LoadUint64(&c.chunkFailures),
+		DroppedEvents:         atomic.LoadUint64(&c.droppedEvents),
+		BootstrapAttempts:     atomic.LoadUint64(&c.bootAttempts),
+		BootstrapSuccesses:    atomic.LoadUint64(&c.bootSuccesses),
+		TimeToFirstConnection: time.Duration(atomic.LoadInt64(&c.firstOnline)),
+		MessagesSent:          atomic.LoadUint64(&c.messagesSent),
+		MessagesReceived:      atomic.LoadUint64(&c.messagesReceived),
+		TransfersCompleted:    atomic.LoadUint64(&c.transfersCompleted),
+		TransfersFailed:       atomic.LoadUint64(&c.transfersFailed),
+		TransfersTimedOut:     atomic.LoadUint64(&c.transfersTimedOut),
+		TransfersCanceled:     atomic.LoadUint64(&c.transfersCanceled),
+		Reconnects:            atomic.LoadUint64(&c.reconnects),
+		BytesSent:             atomic.LoadUint64(&c.bytesSent),
+		BytesReceived:         atomic.LoadUint64(&c.bytesReceived)}
+}
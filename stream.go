@@ -0,0 +1,268 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/codedust/go-tox"
+)
+
+/*
+Lossless packet ids used by the channel. Tox reserves 160 to 191 for custom
+lossless packets.
+*/
+const (
+	packetStream byte = 160
+)
+
+/*
+Stream frame kinds, sent as the second byte of every stream packet.
+*/
+const (
+	frameData byte = iota
+	frameClose
+	frameCredit
+)
+
+/*
+Stream constants.
+*/
+const (
+	// maximal payload of a single stream frame (packet id and frame kind take two bytes)
+	streamPayload = gotox.TOX_MAX_CUSTOM_PACKET_SIZE - 2
+	// maximal amount of received but unread bytes per stream, also the credit a writer starts with
+	streamBuffer = 1 << 20
+	// amount of read bytes after which they are returned to the writer as credit
+	streamCreditBatch = streamBuffer / 4
+)
+
+/*
+stream is a socket like byte pipe to a single address implemented with framed
+lossless packets. There is at most one stream per address. Flow control is
+credit based: a writer may only send as many bytes as the reader has buffer
+space for and blocks until the reader returns credit by reading.
+*/
+type stream struct {
+	channel      *Channel
+	address      Address
+	friend       uint32
+	mutex        sync.Mutex
+	cond         *sync.Cond
+	buffer       bytes.Buffer
+	credit       int   // bytes we may still send before the other side must grant more
+	unacked      int   // bytes read but not yet returned to the other side as credit
+	err          error // set if the stream failed, returned once all data has been read
+	closed       bool  // closed locally
+	remoteClosed bool  // closed by the other side or connection lost
+}
+
+/*
+buildStream creates a stream for the given address.
+*/
+func buildStream(channel *Channel, address Address, friend uint32) *stream {
+	s := &stream{
+		channel: channel,
+		address: address,
+		friend:  friend,
+		credit:  streamBuffer}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+/*
+Read received data, blocking until data is available. Returns io.EOF once the
+stream has been closed by either side and all data has been read, or the error
+the stream failed with.
+*/
+func (s *stream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	for s.buffer.Len() == 0 && !s.closed && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buffer.Len() == 0 {
+		err := s.err
+		s.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n, err := s.buffer.Read(p)
+	s.unacked += n
+	grant := 0
+	if s.unacked >= streamCreditBatch {
+		grant = s.unacked
+		s.unacked = 0
+	}
+	s.mutex.Unlock()
+	if grant > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(grant))
+		// failing to grant only stalls the writer, the data read is still valid
+		if grantErr := s.send(frameCredit, payload); grantErr != nil {
+			s.channel.logger.Debug("Stream: failed to grant credit:", grantErr)
+		}
+	}
+	return n, err
+}
+
+/*
+Write sends the given data to the other side, splitting it into frames.
+*/
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + streamPayload
+		if end > len(p) {
+			end = len(p)
+		}
+		err := s.reserve(end - written)
+		if err != nil {
+			return written, err
+		}
+		err = s.send(frameData, p[written:end])
+		if err != nil {
+			// nothing was sent, so the credit is still ours
+			s.refund(end - written)
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+/*
+Close the stream, notifying the other side.
+*/
+func (s *stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	remoteClosed := s.remoteClosed
+	s.closed = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	s.channel.removeStream(s)
+	if remoteClosed {
+		return nil
+	}
+	return s.send(frameClose, nil)
+}
+
+/*
+reserve blocks until the other side has granted enough credit to send the given
+amount of bytes and consumes it.
+*/
+func (s *stream) reserve(size int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.credit < size && !s.closed && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed || s.remoteClosed {
+		return io.ErrClosedPipe
+	}
+	s.credit -= size
+	return nil
+}
+
+/*
+refund returns credit that was reserved but not used.
+*/
+func (s *stream) refund(size int) {
+	s.mutex.Lock()
+	s.credit += size
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
+
+/*
+dead returns whether a frame of the given kind can no longer be sent. Data may
+only be sent while the stream is open, the other frames until the other side
+has closed it.
+*/
+func (s *stream) dead(kind byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if kind == frameData && (s.closed || s.err != nil) {
+		return true
+	}
+	return s.remoteClosed
+}
+
+/*
+send a single frame, blocking while the rate limit or the Tox send queue don't
+allow it until the stream or the channel is closed.
+*/
+func (s *stream) send(kind byte, payload []byte) error {
+	packet := make([]byte, 0, len(payload)+2)
+	packet = append(packet, packetStream, kind)
+	packet = append(packet, payload...)
+	size := uint64(len(packet))
+	for {
+		if s.dead(kind) {
+			return io.ErrClosedPipe
+		}
+		if s.channel.isClosed() {
+			return ErrClosed
+		}
+		// streams are bulk traffic and must respect the rate limit
+		if s.channel.limit.take(size) {
+			if s.channel.tox.FriendSendLosslessPacket(s.friend, packet) == nil {
+				return nil
+			}
+			// the queue is full, the tokens weren't used
+			s.channel.limit.refund(size)
+		}
+		time.Sleep(s.channel.options.IterateInterval)
+	}
+}
+
+/*
+receive handles an incoming frame.
+*/
+func (s *stream) receive(kind byte, payload []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch kind {
+	case frameData:
+		if s.err != nil {
+			return
+		}
+		// the other side ignored our credit, fail instead of losing data silently
+		if s.buffer.Len()+len(payload) > streamBuffer {
+			s.channel.logger.Warn("Stream:", ErrStreamBufferFull, "failing stream from", s.address)
+			s.err = ErrStreamBufferFull
+			break
+		}
+		s.buffer.Write(payload)
+	case frameCredit:
+		if len(payload) != 4 {
+			s.channel.logger.Debug("Stream: invalid credit frame, ignoring!")
+			return
+		}
+		s.credit += int(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		s.remoteClosed = true
+	default:
+		s.channel.logger.Debug("Stream: unknown frame kind, ignoring!", kind)
+		return
+	}
+	s.cond.Broadcast()
+}
+
+/*
+hangUp marks the stream as closed by the other side, for example because the
+connection was lost.
+*/
+func (s *stream) hangUp() {
+	s.receive(frameClose, nil)
+}
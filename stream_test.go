@@ -0,0 +1,94 @@
+package channel
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+/*
+credit returns the payload of a credit frame granting the given amount.
+*/
+func credit(amount int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(amount))
+	return payload
+}
+
+/*
+TestStreamCredit checks that received frames update the credit and buffer of a
+stream, and that a writer ignoring the credit fails the stream.
+*/
+func TestStreamCredit(t *testing.T) {
+	first, second, _, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	tests := []struct {
+		name     string
+		kind     byte
+		payloads [][]byte
+		credit   int
+		buffered int
+		err      error
+	}{
+		{"credit granted", frameCredit, [][]byte{credit(10), credit(5)}, streamBuffer + 15, 0, nil},
+		{"invalid credit ignored", frameCredit, [][]byte{{1}}, streamBuffer, 0, nil},
+		{"data within buffer", frameData, [][]byte{make([]byte, streamBuffer/2), make([]byte, streamBuffer/2)}, streamBuffer, streamBuffer, nil},
+		{"data beyond buffer", frameData, [][]byte{make([]byte, streamBuffer), {1}}, streamBuffer, streamBuffer, ErrStreamBufferFull},
+	}
+	for _, test := range tests {
+		s := buildStream(first, secondAddress, 0)
+		for _, payload := range test.payloads {
+			s.receive(test.kind, payload)
+		}
+		if s.credit != test.credit || s.buffer.Len() != test.buffered || s.err != test.err {
+			t.Errorf("%s: credit %d, buffered %d, error %v; want %d, %d, %v", test.name,
+				s.credit, s.buffer.Len(), s.err, test.credit, test.buffered, test.err)
+		}
+	}
+}
+
+/*
+TestStreamReserve checks that reserving blocks until enough credit is granted,
+that refunded credit can be reserved again, and that a hung up stream fails.
+*/
+func TestStreamReserve(t *testing.T) {
+	first, second, _, secondAddress := loopbackPair(t)
+	defer first.Close()
+	defer second.Close()
+	s := buildStream(first, secondAddress, 0)
+	if err := s.reserve(streamBuffer); err != nil {
+		t.Fatal(err)
+	}
+	reserved := make(chan error, 1)
+	go func() { reserved <- s.reserve(10) }()
+	select {
+	case err := <-reserved:
+		t.Fatalf("reserved without credit: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.receive(frameCredit, credit(10))
+	select {
+	case err := <-reserved:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reserve did not return after credit was granted")
+	}
+	s.refund(streamBuffer)
+	if err := s.reserve(streamBuffer); err != nil {
+		t.Fatal(err)
+	}
+	go func() { reserved <- s.reserve(1) }()
+	s.hangUp()
+	select {
+	case err := <-reserved:
+		if err != io.ErrClosedPipe {
+			t.Errorf("reserve on hung up stream gave %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reserve did not return after hang up")
+	}
+}
@@ -0,0 +1,715 @@
+package channel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codedust/go-tox"
+)
+
+/*
+toxCore is the part of gotox the channel uses. It is implemented by *gotox.Tox
+and by the in memory backend of CreateMemoryPair, and can be implemented by
+tests to drive the channel deterministically, see createWithTox.
+*/
+type toxCore interface {
+	Kill() error
+	GetSavedata() ([]byte, error)
+	Bootstrap(address string, port uint16, publickey []byte) error
+	AddTcpRelay(address string, port uint16, publickey []byte) error
+	IterationInterval() (int64, error)
+	Iterate() error
+	// self
+	SelfGetConnectionStatus() (gotox.ToxConnection, error)
+	SelfGetAddress() ([]byte, error)
+	SelfSetNospam(nospam uint32) error
+	SelfGetNospam() (uint32, error)
+	SelfSetName(name string) error
+	SelfGetName() (string, error)
+	SelfSetStatusMessage(status string) error
+	SelfGetStatusMessage() (string, error)
+	SelfSetStatus(userstatus gotox.ToxUserStatus) error
+	SelfGetFriendlist() ([]uint32, error)
+	SelfGetDhtID() ([]byte, error)
+	SelfGetUDPPort() (uint16, error)
+	SelfGetTCPPort() (uint16, error)
+	// friends
+	FriendAdd(address []byte, message string) (uint32, error)
+	FriendAddNorequest(publickey []byte) (uint32, error)
+	FriendDelete(friendnumber uint32) error
+	FriendByPublicKey(publickey []byte) (uint32, error)
+	FriendGetPublickey(friendnumber uint32) ([]byte, error)
+	FriendGetLastOnline(friendnumber uint32) (time.Time, error)
+	FriendGetName(friendnumber uint32) (string, error)
+	FriendGetStatusMessage(friendnumber uint32) (string, error)
+	FriendGetStatus(friendnumber uint32) (gotox.ToxUserStatus, error)
+	FriendGetConnectionStatus(friendnumber uint32) (gotox.ToxConnection, error)
+	FriendGetTyping(friendnumber uint32) (bool, error)
+	FriendSendMessage(friendnumber uint32, messagetype gotox.ToxMessageType, message string) (uint32, error)
+	FriendSendLossyPacket(friendnumber uint32, data []byte) error
+	FriendSendLosslessPacket(friendnumber uint32, data []byte) error
+	// files
+	FileControl(friendnumber uint32, filenumber uint32, filecontrol gotox.ToxFileControl) error
+	FileSend(friendnumber uint32, kind gotox.ToxFileKind, filesize uint64, fileid []byte, filename string) (uint32, error)
+	FileSendChunk(friendnumber uint32, filenumber uint32, position uint64, data []byte) error
+	// callbacks
+	CallbackFriendRequest(f gotox.CallbackFriendRequest)
+	CallbackFriendMessage(f gotox.CallbackFriendMessage)
+	CallbackFriendNameChanges(f gotox.CallbackFriendNameChanges)
+	CallbackFriendStatusMessageChanges(f gotox.CallbackFriendStatusMessageChanges)
+	CallbackFriendStatusChanges(f gotox.CallbackFriendStatusChanges)
+	CallbackFriendConnectionStatusChanges(f gotox.CallbackFriendConnectionStatusChanges)
+	CallbackFriendReadReceipt(f gotox.CallbackFriendReadReceipt)
+	CallbackSelfConnectionStatusChanges(f gotox.CallbackSelfConnectionStatusChanges)
+	CallbackFileRecvControl(f gotox.CallbackFileRecvControl)
+	CallbackFileRecv(f gotox.CallbackFileRecv)
+	CallbackFileRecvChunk(f gotox.CallbackFileRecvChunk)
+	CallbackFileChunkRequest(f gotox.CallbackFileChunkRequest)
+	CallbackFriendLossyPacket(f gotox.CallbackFriendLossyPacket)
+	CallbackFriendLosslessPacket(f gotox.CallbackFriendLosslessPacket)
+}
+
+/*
+The real Tox must always implement toxCore.
+*/
+var _ toxCore = (*gotox.Tox)(nil)
+
+/*
+lockedTox guards the Tox instance of a channel so that the background thread can
+replace it on a restart while public methods use it. Every call holds the read
+lock, replacing and killing take the write lock. Once killed all calls fail with
+ErrClosed, so that nothing touches the freed instance.
+
+Iterate, swap, and Kill are only called by the background thread, or by Close
+once it has stopped, so they never overlap. Iterate therefore takes no lock: the
+callbacks it runs call back into the guard, and a read lock held around them
+would deadlock behind a waiting swap or Kill.
+*/
+type lockedTox struct {
+	mutex  sync.RWMutex
+	tox    toxCore
+	killed bool
+}
+
+/*
+The guard must always implement toxCore.
+*/
+var _ toxCore = (*lockedTox)(nil)
+
+/*
+lockTox guards the given Tox instance.
+*/
+func lockTox(tox toxCore) *lockedTox {
+	return &lockedTox{tox: tox}
+}
+
+/*
+swap replaces the Tox instance with the given one and kills the old one once no
+call is using it anymore.
+*/
+func (t *lockedTox) swap(tox toxCore) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tox.Kill()
+	t.tox = tox
+}
+
+/*
+Kill calls Tox once no call is using it anymore. All later calls fail.
+*/
+func (t *lockedTox) Kill() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.killed {
+		return ErrClosed
+	}
+	t.killed = true
+	return t.tox.Kill()
+}
+
+/*
+GetSavedata calls Tox unless it has been killed.
+*/
+func (t *lockedTox) GetSavedata() ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return nil, ErrClosed
+	}
+	return t.tox.GetSavedata()
+}
+
+/*
+Bootstrap calls Tox unless it has been killed.
+*/
+func (t *lockedTox) Bootstrap(address string, port uint16, publickey []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.Bootstrap(address, port, publickey)
+}
+
+/*
+AddTcpRelay calls Tox unless it has been killed.
+*/
+func (t *lockedTox) AddTcpRelay(address string, port uint16, publickey []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.AddTcpRelay(address, port, publickey)
+}
+
+/*
+IterationInterval calls Tox unless it has been killed.
+*/
+func (t *lockedTox) IterationInterval() (int64, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.IterationInterval()
+}
+
+/*
+Iterate calls Tox unless it has been killed. Must only be called by the
+goroutine that swaps and kills, see lockedTox.
+*/
+func (t *lockedTox) Iterate() error {
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.Iterate()
+}
+
+/*
+SelfGetConnectionStatus calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetConnectionStatus() (gotox.ToxConnection, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return gotox.TOX_CONNECTION_NONE, ErrClosed
+	}
+	return t.tox.SelfGetConnectionStatus()
+}
+
+/*
+SelfGetAddress calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetAddress() ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return nil, ErrClosed
+	}
+	return t.tox.SelfGetAddress()
+}
+
+/*
+SelfSetNospam calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfSetNospam(nospam uint32) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.SelfSetNospam(nospam)
+}
+
+/*
+SelfGetNospam calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetNospam() (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.SelfGetNospam()
+}
+
+/*
+SelfSetName calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfSetName(name string) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.SelfSetName(name)
+}
+
+/*
+SelfGetName calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetName() (string, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return "", ErrClosed
+	}
+	return t.tox.SelfGetName()
+}
+
+/*
+SelfSetStatusMessage calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfSetStatusMessage(status string) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.SelfSetStatusMessage(status)
+}
+
+/*
+SelfGetStatusMessage calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetStatusMessage() (string, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return "", ErrClosed
+	}
+	return t.tox.SelfGetStatusMessage()
+}
+
+/*
+SelfSetStatus calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfSetStatus(userstatus gotox.ToxUserStatus) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.SelfSetStatus(userstatus)
+}
+
+/*
+SelfGetFriendlist calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetFriendlist() ([]uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return nil, ErrClosed
+	}
+	return t.tox.SelfGetFriendlist()
+}
+
+/*
+SelfGetDhtID calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetDhtID() ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return nil, ErrClosed
+	}
+	return t.tox.SelfGetDhtID()
+}
+
+/*
+SelfGetUDPPort calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetUDPPort() (uint16, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.SelfGetUDPPort()
+}
+
+/*
+SelfGetTCPPort calls Tox unless it has been killed.
+*/
+func (t *lockedTox) SelfGetTCPPort() (uint16, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.SelfGetTCPPort()
+}
+
+/*
+FriendAdd calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendAdd(address []byte, message string) (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.FriendAdd(address, message)
+}
+
+/*
+FriendAddNorequest calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendAddNorequest(publickey []byte) (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.FriendAddNorequest(publickey)
+}
+
+/*
+FriendDelete calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendDelete(friendnumber uint32) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.FriendDelete(friendnumber)
+}
+
+/*
+FriendByPublicKey calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendByPublicKey(publickey []byte) (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.FriendByPublicKey(publickey)
+}
+
+/*
+FriendGetPublickey calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetPublickey(friendnumber uint32) ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return nil, ErrClosed
+	}
+	return t.tox.FriendGetPublickey(friendnumber)
+}
+
+/*
+FriendGetLastOnline calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetLastOnline(friendnumber uint32) (time.Time, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return time.Time{}, ErrClosed
+	}
+	return t.tox.FriendGetLastOnline(friendnumber)
+}
+
+/*
+FriendGetName calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetName(friendnumber uint32) (string, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return "", ErrClosed
+	}
+	return t.tox.FriendGetName(friendnumber)
+}
+
+/*
+FriendGetStatusMessage calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetStatusMessage(friendnumber uint32) (string, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return "", ErrClosed
+	}
+	return t.tox.FriendGetStatusMessage(friendnumber)
+}
+
+/*
+FriendGetStatus calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetStatus(friendnumber uint32) (gotox.ToxUserStatus, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return gotox.TOX_USERSTATUS_NONE, ErrClosed
+	}
+	return t.tox.FriendGetStatus(friendnumber)
+}
+
+/*
+FriendGetConnectionStatus calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetConnectionStatus(friendnumber uint32) (gotox.ToxConnection, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return gotox.TOX_CONNECTION_NONE, ErrClosed
+	}
+	return t.tox.FriendGetConnectionStatus(friendnumber)
+}
+
+/*
+FriendGetTyping calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendGetTyping(friendnumber uint32) (bool, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return false, ErrClosed
+	}
+	return t.tox.FriendGetTyping(friendnumber)
+}
+
+/*
+FriendSendMessage calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendSendMessage(friendnumber uint32, messagetype gotox.ToxMessageType, message string) (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.FriendSendMessage(friendnumber, messagetype, message)
+}
+
+/*
+FriendSendLossyPacket calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendSendLossyPacket(friendnumber uint32, data []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.FriendSendLossyPacket(friendnumber, data)
+}
+
+/*
+FriendSendLosslessPacket calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FriendSendLosslessPacket(friendnumber uint32, data []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.FriendSendLosslessPacket(friendnumber, data)
+}
+
+/*
+FileControl calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FileControl(friendnumber uint32, filenumber uint32, filecontrol gotox.ToxFileControl) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.FileControl(friendnumber, filenumber, filecontrol)
+}
+
+/*
+FileSend calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FileSend(friendnumber uint32, kind gotox.ToxFileKind, filesize uint64, fileid []byte, filename string) (uint32, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return 0, ErrClosed
+	}
+	return t.tox.FileSend(friendnumber, kind, filesize, fileid, filename)
+}
+
+/*
+FileSendChunk calls Tox unless it has been killed.
+*/
+func (t *lockedTox) FileSendChunk(friendnumber uint32, filenumber uint32, position uint64, data []byte) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return ErrClosed
+	}
+	return t.tox.FileSendChunk(friendnumber, filenumber, position, data)
+}
+
+/*
+CallbackFriendRequest registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendRequest(f gotox.CallbackFriendRequest) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendRequest(f)
+}
+
+/*
+CallbackFriendMessage registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendMessage(f gotox.CallbackFriendMessage) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendMessage(f)
+}
+
+/*
+CallbackFriendNameChanges registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendNameChanges(f gotox.CallbackFriendNameChanges) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendNameChanges(f)
+}
+
+/*
+CallbackFriendStatusMessageChanges registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendStatusMessageChanges(f gotox.CallbackFriendStatusMessageChanges) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendStatusMessageChanges(f)
+}
+
+/*
+CallbackFriendStatusChanges registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendStatusChanges(f gotox.CallbackFriendStatusChanges) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendStatusChanges(f)
+}
+
+/*
+CallbackFriendConnectionStatusChanges registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendConnectionStatusChanges(f gotox.CallbackFriendConnectionStatusChanges) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendConnectionStatusChanges(f)
+}
+
+/*
+CallbackFriendReadReceipt registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendReadReceipt(f gotox.CallbackFriendReadReceipt) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendReadReceipt(f)
+}
+
+/*
+CallbackSelfConnectionStatusChanges registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackSelfConnectionStatusChanges(f gotox.CallbackSelfConnectionStatusChanges) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackSelfConnectionStatusChanges(f)
+}
+
+/*
+CallbackFileRecvControl registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFileRecvControl(f gotox.CallbackFileRecvControl) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFileRecvControl(f)
+}
+
+/*
+CallbackFileRecv registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFileRecv(f gotox.CallbackFileRecv) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFileRecv(f)
+}
+
+/*
+CallbackFileRecvChunk registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFileRecvChunk(f gotox.CallbackFileRecvChunk) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFileRecvChunk(f)
+}
+
+/*
+CallbackFileChunkRequest registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFileChunkRequest(f gotox.CallbackFileChunkRequest) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFileChunkRequest(f)
+}
+
+/*
+CallbackFriendLossyPacket registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendLossyPacket(f gotox.CallbackFriendLossyPacket) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendLossyPacket(f)
+}
+
+/*
+CallbackFriendLosslessPacket registers with Tox unless it has been killed.
+*/
+func (t *lockedTox) CallbackFriendLosslessPacket(f gotox.CallbackFriendLosslessPacket) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.killed {
+		return
+	}
+	t.tox.CallbackFriendLosslessPacket(f)
+}
@@ -0,0 +1,76 @@
+package channel
+
+import (
+	"errors"
+	"strconv"
+)
+
+/*
+Tracer starts spans around long running operations of the channel. It is kept
+minimal so that it can easily be backed by OpenTelemetry or any other tracing
+library. Spans are started with these names:
+
+	bootstrap          a bootstrap round, until online or the next round
+	transfer.send      a file transfer to a friend, until it is closed
+	transfer.receive   a file transfer from a friend, until it is closed
+	message.reliable   SendReliable, until the read receipt arrives
+	ping               Ping, until the pong arrives
+*/
+type Tracer interface {
+	/*Start a span with the given name and attributes.*/
+	Start(name string, attributes map[string]string) Span
+}
+
+/*
+Span is a single operation started by a Tracer.
+*/
+type Span interface {
+	/*SetAttribute adds an attribute to the span.*/
+	SetAttribute(key, value string)
+	/*End the span. A non nil error marks the operation as failed.*/
+	End(err error)
+}
+
+/*
+noopSpan is used when no Tracer is set.
+*/
+type noopSpan struct{}
+
+/*SetAttribute does nothing.*/
+func (noopSpan) SetAttribute(key, value string) {}
+
+/*End does nothing.*/
+func (noopSpan) End(err error) {}
+
+/*
+startSpan starts a span with the Tracer of the options. The attributes are given
+as key value pairs.
+*/
+func (channel *Channel) startSpan(name string, attributes ...string) Span {
+	if channel.options.Tracer == nil {
+		return noopSpan{}
+	}
+	attrs := make(map[string]string)
+	for i := 0; i+1 < len(attributes); i += 2 {
+		attrs[attributes[i]] = attributes[i+1]
+	}
+	return channel.options.Tracer.Start(name, attrs)
+}
+
+/*
+stateErr returns nil for a successful state, otherwise an error naming it, for
+ending spans.
+*/
+func stateErr(state State) error {
+	if state == StSuccess {
+		return nil
+	}
+	return errors.New("transfer " + state.String())
+}
+
+/*
+formatUint formats the given number as an attribute value.
+*/
+func formatUint(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
@@ -1,8 +1,11 @@
 package channel
 
 import (
-	"log"
+	"context"
 	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -14,15 +17,30 @@ type transfer struct {
 	friend       uint32
 	file         *os.File
 	size         uint64
-	progress     uint64
+	progress     uint64    // accessed atomically
+	touched      int64     // unix nanoseconds of the last progress, accessed atomically
+	began        time.Time // when the transfer started running
 	doneCallback func(status State)
 	isDone       bool
+	retries      int             // consecutive transient chunk send failures
+	ctx          context.Context // cancels the transfer when done, nil for received transfers
+	timeout      time.Duration   // overrides Options.SendTimeout if set
+	span         Span            // traces the transfer once it started, nil before
+	pending      []byte          // received data not written yet, from writeBuffers
+	pendingAt    uint64          // position of pending in the file
+	buffer       int             // bytes to collect in pending, none if not positive
+	sync         SyncPolicy      // when the file is synced
+	syncEvery    uint64          // bytes between syncs with SpPeriodic
+	unsynced     uint64          // bytes written since the last sync
+	mapped       []byte          // the sent file in memory if Options.MapFiles is set
+	ahead        *readAhead      // reads the sent file ahead if Options.ReadAhead is set
+	log          Logger
 }
 
 /*
 createTransfer builds a transfer object for the given file and the given callback.
 */
-func createTransfer(path, name string, friendNumber uint32, file *os.File, size uint64, callback func(status State)) *transfer {
+func createTransfer(path, name string, friendNumber uint32, file *os.File, size uint64, callback func(status State), logger Logger) *transfer {
 	return &transfer{
 		path:         path,
 		name:         name,
@@ -31,14 +49,143 @@ func createTransfer(path, name string, friendNumber uint32, file *os.File, size
 		size:         size,
 		progress:     0,
 		doneCallback: callback,
-		isDone:       false}
+		isDone:       false,
+		log:          logger}
+}
+
+/*
+canceled returns whether the context of the transfer has expired.
+*/
+func (t *transfer) canceled() bool {
+	return t.ctx != nil && t.ctx.Err() != nil
 }
 
 /*
 SetProgress value of this transfer.
 */
 func (t *transfer) SetProgress(value uint64) {
-	t.progress = value
+	atomic.StoreUint64(&t.progress, value)
+	t.touch()
+}
+
+/*
+touch notes that the transfer just made progress.
+*/
+func (t *transfer) touch() {
+	atomic.StoreInt64(&t.touched, time.Now().UnixNano())
+}
+
+/*
+stalled returns whether the transfer made no progress for longer than the given
+duration.
+*/
+func (t *transfer) stalled(after time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.touched))) > after
+}
+
+/*
+write collects the received data, writing it to the file once the buffer is full
+or the data doesn't continue it. Returns whether the file was written.
+*/
+func (t *transfer) write(position uint64, data []byte) (bool, error) {
+	if t.buffer <= 0 {
+		return true, t.writeAt(data, position)
+	}
+	var written bool
+	if len(t.pending) > 0 && (position != t.pendingAt+uint64(len(t.pending)) || len(t.pending)+len(data) > cap(t.pending)) {
+		written = true
+		if err := t.flush(); err != nil {
+			return written, err
+		}
+	}
+	// too large to collect
+	if len(data) > t.buffer {
+		return true, t.writeAt(data, position)
+	}
+	if t.pending == nil {
+		t.pending = getWriteBuffer(t.buffer)
+	}
+	if len(t.pending) == 0 {
+		t.pendingAt = position
+	}
+	t.pending = append(t.pending, data...)
+	return written, nil
+}
+
+/*
+flush writes the collected data to the file.
+*/
+func (t *transfer) flush() error {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	err := t.writeAt(t.pending, t.pendingAt)
+	t.pending = t.pending[:0]
+	return err
+}
+
+/*
+writeAt writes the data to the file, syncing it if the SyncPolicy asks for it.
+*/
+func (t *transfer) writeAt(data []byte, position uint64) error {
+	_, err := t.file.WriteAt(data, int64(position))
+	if err != nil || t.sync != SpPeriodic {
+		return err
+	}
+	t.unsynced += uint64(len(data))
+	if t.unsynced < t.syncEvery {
+		return nil
+	}
+	t.unsynced = 0
+	return t.file.Sync()
+}
+
+/*
+readChunk reads the chunk at the given position of the sent file into data,
+copying it from the mapped file or the read ahead if possible.
+*/
+func (t *transfer) readChunk(position uint64, data []byte) error {
+	// the mapping only covers the size the file had when the transfer was created
+	if t.mapped != nil && position <= uint64(len(t.mapped)) && uint64(len(data)) <= uint64(len(t.mapped))-position {
+		return copyMapped(data, t.mapped, position)
+	}
+	if t.ahead != nil && t.ahead.read(position, data) {
+		return nil
+	}
+	_, err := t.file.ReadAt(data, int64(position))
+	return err
+}
+
+/*
+copyMapped copies the mapped data at the given position into data. Touching
+pages of a file that was truncated after mapping raises SIGBUS, which is turned
+into ErrFileTruncated instead of crashing the process.
+*/
+func copyMapped(data, mapped []byte, position uint64) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = ErrFileTruncated
+		}
+	}()
+	copy(data, mapped[position:])
+	return nil
+}
+
+/*
+discard releases the file of a transfer that was never started, without
+calling the done callback.
+*/
+func (t *transfer) discard() {
+	if t.mapped != nil {
+		if err := unmapFile(t.mapped); err != nil {
+			t.log.Error("Transfer: unmap:", err)
+		}
+		t.mapped = nil
+	}
+	if err := t.file.Close(); err != nil {
+		t.log.Error("Transfer: file.Close:", err)
+	}
 }
 
 /*
@@ -46,35 +193,74 @@ Percentage returns in percent the amount already transfered.
 */
 func (t *transfer) Percentage() int {
 	// catch zero values
-	if t.progress == 0 || t.size == 0 {
+	progress := atomic.LoadUint64(&t.progress)
+	if progress == 0 || t.size == 0 {
 		return 0
 	}
 	// calculate
-	return int(100.0 * (float32(t.progress) / float32(t.size)))
+	return int(100.0 * (float32(progress) / float32(t.size)))
 }
 
 /*
-close can be called to finish the transfer.
+close can be called to finish the transfer. A successful transfer whose data
+can't be written out completely fails instead. Returns the state the transfer
+finished with.
 */
-func (t *transfer) Close(state State) {
+func (t *transfer) Close(state State) State {
 	if t.isDone {
-		log.Println("Transfer: WARNING: already closed! Won't execute.")
-		return
+		t.log.Warn("Transfer: already closed! Won't execute.")
+		return state
 	}
 	// flag that we're done
 	t.isDone = true
 	// finish writing file
-	err := t.file.Sync()
-	if err != nil {
-		log.Println("Transfer: file.Sync:", err)
+	if t.pending != nil {
+		if err := t.flush(); err != nil {
+			t.log.Error("Transfer: write:", err)
+			state = failedIfSuccess(state)
+		}
+		putWriteBuffer(t.pending)
+		t.pending = nil
+	}
+	if t.ahead != nil {
+		t.ahead.stop()
+		t.ahead = nil
+	}
+	if t.mapped != nil {
+		if err := unmapFile(t.mapped); err != nil {
+			t.log.Error("Transfer: unmap:", err)
+		}
+		t.mapped = nil
 	}
-	err = t.file.Close()
+	if t.sync != SpNever {
+		if err := t.file.Sync(); err != nil {
+			t.log.Error("Transfer: file.Sync:", err)
+			state = failedIfSuccess(state)
+		}
+	}
+	err := t.file.Close()
 	if err != nil {
-		log.Println("Transfer: file.Close:", err)
+		t.log.Error("Transfer: file.Close:", err)
+		state = failedIfSuccess(state)
+	}
+	if t.span != nil {
+		t.span.SetAttribute("state", state.String())
+		t.span.End(stateErr(state))
 	}
 	// execute callback if exists
 	if t.doneCallback != nil {
 		t.doneCallback(state)
 	}
 	// and we're done
+	return state
+}
+
+/*
+failedIfSuccess turns a successful state into a failed one, keeping any other.
+*/
+func failedIfSuccess(state State) State {
+	if state == StSuccess {
+		return StFailed
+	}
+	return state
 }
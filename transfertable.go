@@ -0,0 +1,182 @@
+package channel
+
+import "time"
+
+/*
+transferTable tracks all transfers: the running ones by Tox file number, the
+queued ones by address, and which address currently has a send in progress. It
+is owned by the background thread, which also runs the Tox callbacks; public
+methods hand their work to it with do.
+*/
+type transferTable struct {
+	running map[uint32]*transfer       // all ongoing transfers: key is Tox file number
+	queues  map[Address]chan *transfer // pending transfers: key is address where transfer is going to
+	active  map[Address]*sendTransfer  // send in progress: key is address
+}
+
+/*
+buildTransferTable creates an empty table.
+*/
+func buildTransferTable() *transferTable {
+	return &transferTable{
+		running: make(map[uint32]*transfer),
+		queues:  make(map[Address]chan *transfer),
+		active:  make(map[Address]*sendTransfer)}
+}
+
+/*
+get the running transfer of the given file number.
+*/
+func (t *transferTable) get(fileNumber uint32) (*transfer, bool) {
+	tran, exists := t.running[fileNumber]
+	return tran, exists
+}
+
+/*
+add a running transfer.
+*/
+func (t *transferTable) add(fileNumber uint32, tran *transfer) {
+	tran.began = time.Now()
+	tran.touch()
+	t.running[fileNumber] = tran
+}
+
+/*
+remove the running transfer of the given file number. Only the caller that
+removed a transfer may close it.
+*/
+func (t *transferTable) remove(fileNumber uint32) (*transfer, bool) {
+	tran, exists := t.running[fileNumber]
+	delete(t.running, fileNumber)
+	return tran, exists
+}
+
+/*
+find the running transfer writing to or reading from the given path.
+*/
+func (t *transferTable) find(path string) (uint32, *transfer, bool) {
+	for fileNumber, tran := range t.running {
+		if tran.path == path {
+			return fileNumber, tran, true
+		}
+	}
+	return 0, nil, false
+}
+
+/*
+ofFriend returns the running transfers of the given friend.
+*/
+func (t *transferTable) ofFriend(friend uint32) map[uint32]*transfer {
+	list := make(map[uint32]*transfer)
+	for fileNumber, tran := range t.running {
+		if tran.friend == friend {
+			list[fileNumber] = tran
+		}
+	}
+	return list
+}
+
+/*
+all returns a snapshot of the running transfers.
+*/
+func (t *transferTable) all() map[uint32]*transfer {
+	list := make(map[uint32]*transfer)
+	for fileNumber, tran := range t.running {
+		list[fileNumber] = tran
+	}
+	return list
+}
+
+/*
+count returns the number of running transfers.
+*/
+func (t *transferTable) count() int {
+	return len(t.running)
+}
+
+/*
+queue returns the queue of pending transfers of the given address, creating it
+if required.
+*/
+func (t *transferTable) queue(address Address) chan *transfer {
+	queue, exists := t.queues[address]
+	if !exists {
+		// TODO make chan size setable etc
+		queue = make(chan *transfer, 64)
+		t.queues[address] = queue
+	}
+	return queue
+}
+
+/*
+allQueues returns a snapshot of the queues by address.
+*/
+func (t *transferTable) allQueues() map[Address]chan *transfer {
+	list := make(map[Address]chan *transfer)
+	for address, queue := range t.queues {
+		list[address] = queue
+	}
+	return list
+}
+
+/*
+removeQueue removes the queue of the given address.
+*/
+func (t *transferTable) removeQueue(address Address) (chan *transfer, bool) {
+	queue, exists := t.queues[address]
+	delete(t.queues, address)
+	return queue, exists
+}
+
+/*
+activeOf returns the send in progress to the given address.
+*/
+func (t *transferTable) activeOf(address Address) (*sendTransfer, bool) {
+	sendTran, exists := t.active[address]
+	return sendTran, exists
+}
+
+/*
+setActive marks a send in progress to the given address.
+*/
+func (t *transferTable) setActive(address Address, sendTran *sendTransfer) {
+	t.active[address] = sendTran
+}
+
+/*
+removeActive removes the send in progress to the given address, if any.
+*/
+func (t *transferTable) removeActive(address Address) {
+	delete(t.active, address)
+}
+
+/*
+clearActive removes all sends in progress.
+*/
+func (t *transferTable) clearActive() {
+	t.active = make(map[Address]*sendTransfer)
+}
+
+/*
+idle returns true if no transfers are running, in progress, or queued.
+*/
+func (t *transferTable) idle() bool {
+	if len(t.running) > 0 || len(t.active) > 0 {
+		return false
+	}
+	for _, queue := range t.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+clearQueues removes all queues and returns them.
+*/
+func (t *transferTable) clearQueues() map[Address]chan *transfer {
+	queues := t.queues
+	t.queues = make(map[Address]chan *transfer)
+	return queues
+}